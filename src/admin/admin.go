@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"connect-companion/config"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Init регистрирует административные методы под /admin/ с basic-авторизацией
+func Init(app *gin.Engine, cnf *config.Conf) {
+	if cnf.Admin.Login == "" {
+		logger.Info("Admin interface disabled")
+		return
+	}
+
+	logger.Info("Init admin endpoints...")
+
+	group := app.Group("/admin", gin.BasicAuth(gin.Accounts{cnf.Admin.Login: cnf.Admin.Password}), auditAdmin)
+
+	group.GET("/survey/export/", surveyExport)
+	group.GET("/survey/stats/", surveyStats)
+
+	group.GET("/webhooks/dead/", webhookDeadLetters)
+	group.POST("/webhooks/dead/retry/", webhookRetry)
+
+	group.GET("/hooks/", hooksStatus)
+	group.POST("/hooks/resync/", hooksResync)
+
+	group.GET("/flow/diagram/", flowDiagram)
+
+	group.GET("/experiments/", experimentsReport)
+	group.DELETE("/experiments/:name", experimentsReset)
+
+	group.GET("/flood/blocklist/", floodBlocklist)
+	group.PUT("/flood/blocklist/:user", floodBlock)
+	group.DELETE("/flood/blocklist/:user", floodUnblock)
+	group.GET("/flood/mutes/", floodMutes)
+	group.DELETE("/flood/mutes/:user", floodUnmute)
+
+	group.GET("/audit/", auditLog)
+
+	group.GET("/privacy/:user/export", privacyExport)
+	group.DELETE("/privacy/:user", privacyErase)
+}
+
+// periodParams разбирает параметры from и to (RFC3339 или YYYY-MM-DD), по умолчанию - последние 30 дней
+func periodParams(c *gin.Context) (from time.Time, to time.Time, ok bool) {
+	to = time.Now()
+	from = to.AddDate(0, 0, -30)
+
+	for param, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			t, err = time.ParseInLocation("2006-01-02", raw, time.Local)
+			if err == nil && param == "to" {
+				t = t.AddDate(0, 0, 1).Add(-time.Second)
+			}
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad " + param + ": " + err.Error()})
+			return from, to, false
+		}
+
+		*value = t
+	}
+
+	return from, to, true
+}
+
+// lineParams возвращает линию из параметра line или все линии из конфигурации
+func lineParams(c *gin.Context) ([]uuid.UUID, bool) {
+	cnf := c.MustGet("cnf").(*config.Conf)
+
+	raw := c.Query("line")
+	if raw == "" {
+		return cnf.Line, true
+	}
+
+	lineId, err := uuid.Parse(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad line: " + err.Error()})
+		return nil, false
+	}
+
+	return []uuid.UUID{lineId}, true
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"connect-companion/bot/audit"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+// auditAdmin записывает в журнал изменения через админку: метод, путь, кто и с каким кодом.
+// Чтение не записывается, кроме выгрузки персональных данных - ее пишет сам privacy
+func auditAdmin(c *gin.Context) {
+	c.Next()
+
+	if c.Request.Method == http.MethodGet {
+		return
+	}
+
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	entry := audit.Entry{
+		Actor:  adminActor(c),
+		Action: audit.ACTION_ADMIN,
+		Result: audit.RESULT_OK,
+		Code:   c.Writer.Status(),
+		Details: map[string]interface{}{
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+		},
+	}
+	if c.Writer.Status() >= http.StatusBadRequest {
+		entry.Result = audit.RESULT_ERROR
+	}
+	if userId, err := uuid.Parse(c.Param("user")); err == nil {
+		entry.UserId = &userId
+	}
+
+	if err := audit.Record(db, entry); err != nil {
+		logger.Warning("Error while record audit", err)
+	}
+}
+
+// auditLog показывает журнал, сначала новые записи. Параметры: user, line, action,
+// from и to (по умолчанию последние 30 дней), limit (по умолчанию 1000)
+func auditLog(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	from, to, ok := periodParams(c)
+	if !ok {
+		return
+	}
+	filter := audit.Filter{From: from, To: to, Action: c.Query("action")}
+
+	for param, value := range map[string]**uuid.UUID{"user": &filter.UserId, "line": &filter.LineId} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad " + param + ": " + err.Error()})
+			return
+		}
+		*value = &id
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad limit"})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := audit.Query(db, filter)
+	if err != nil {
+		logger.Warning("Error while read audit", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
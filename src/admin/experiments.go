@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"net/http"
+
+	"connect-companion/bot/experiments"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+)
+
+// experimentsReport показывает исходы диалогов по вариантам экспериментов
+func experimentsReport(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	report, err := experiments.Report(db)
+	if err != nil {
+		logger.Warning("Error while read experiments", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// experimentsReset обнуляет счетчики эксперимента. Варианты чатов сохраняются
+func experimentsReset(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	if err := experiments.Reset(db, c.Param("name")); err != nil {
+		logger.Warning("Error while reset experiment", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
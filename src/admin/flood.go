@@ -0,0 +1,73 @@
+package admin
+
+import (
+	"net/http"
+
+	"connect-companion/bot/flood"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+// floodBlocklist показывает черный список из конфигурации и добавленных через админку
+func floodBlocklist(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	list, err := flood.Blocklist(db)
+	if err != nil {
+		logger.Warning("Error while read blocklist", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+func floodBlock(c *gin.Context) {
+	floodChange(c, flood.Block)
+}
+
+func floodUnblock(c *gin.Context) {
+	floodChange(c, flood.Unblock)
+}
+
+// floodMutes показывает действующие временные блокировки за флуд
+func floodMutes(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	list, err := flood.Mutes(db)
+	if err != nil {
+		logger.Warning("Error while read mutes", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+func floodUnmute(c *gin.Context) {
+	floodChange(c, flood.Unmute)
+}
+
+func floodChange(c *gin.Context, change func(db redis.UniversalClient, userId uuid.UUID) error) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	userId, err := uuid.Parse(c.Param("user"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user: " + err.Error()})
+		return
+	}
+
+	if err = change(db, userId); err != nil {
+		logger.Warning("Error while change flood settings of", userId.String(), err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
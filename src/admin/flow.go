@@ -0,0 +1,32 @@
+package admin
+
+import (
+	"bytes"
+	"net/http"
+
+	"connect-companion/bot"
+
+	"github.com/gin-gonic/gin"
+)
+
+// flowDiagram отдает схему диалога: format=mermaid (по умолчанию), dot или json
+func flowDiagram(c *gin.Context) {
+	format := c.DefaultQuery("format", bot.DIAGRAM_MERMAID)
+	if format == "json" {
+		c.JSON(http.StatusOK, bot.FlowDiagram())
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := bot.WriteDiagram(&buf, format); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if format == bot.DIAGRAM_DOT {
+		contentType = "text/vnd.graphviz; charset=utf-8"
+	}
+
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
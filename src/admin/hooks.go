@@ -0,0 +1,24 @@
+package admin
+
+import (
+	"net/http"
+
+	"connect-companion/bot"
+	"connect-companion/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hooksStatus показывает состояние хуков на линиях из конфигурации
+func hooksStatus(c *gin.Context) {
+	cnf := c.MustGet("cnf").(*config.Conf)
+
+	c.JSON(http.StatusOK, bot.HooksStatus(cnf.Line))
+}
+
+// hooksResync запускает установку хуков, не дожидаясь очередной проверки
+func hooksResync(c *gin.Context) {
+	bot.ResyncHooks()
+
+	c.Status(http.StatusAccepted)
+}
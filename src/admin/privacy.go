@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"connect-companion/bot/privacy"
+	"connect-companion/config"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+// privacyExport отдает zip-архив со всем, что бот хранит о пользователе
+func privacyExport(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+	cnf := c.MustGet("cnf").(*config.Conf)
+
+	userId, err := uuid.Parse(c.Param("user"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user: " + err.Error()})
+		return
+	}
+
+	data, err := privacy.Collect(db, cnf, userId)
+	if err != nil {
+		logger.Warning("Error while collect personal data", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	// Архив собирается во временный файл до ответа, чтобы при ошибке вернуть 500, а не обрезанный zip
+	archive, err := ioutil.TempFile("", "privacy-*.zip")
+	if err != nil {
+		logger.Warning("Error while create archive", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	if err = privacy.Export(db, cnf, data, adminActor(c), archive); err != nil {
+		logger.Warning("Error while export personal data", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	size, err := archive.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = archive.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		logger.Warning("Error while read archive", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.DataFromReader(http.StatusOK, size, "application/zip", archive, map[string]string{
+		"Content-Disposition": `attachment; filename="` + userId.String() + `.zip"`,
+	})
+}
+
+// privacyErase удаляет все данные пользователя и возвращает, сколько чего удалено
+func privacyErase(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+	cnf := c.MustGet("cnf").(*config.Conf)
+
+	userId, err := uuid.Parse(c.Param("user"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user: " + err.Error()})
+		return
+	}
+
+	erasure, err := privacy.Erase(db, cnf, userId, adminActor(c))
+	if err != nil {
+		logger.Warning("Error while erase personal data", err)
+
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "deleted": erasure.Deleted})
+		return
+	}
+
+	c.JSON(http.StatusOK, erasure)
+}
+
+// adminActor - кто выполняет действие, для журнала аудита
+func adminActor(c *gin.Context) string {
+	return "admin:" + c.GetString(gin.AuthUserKey)
+}
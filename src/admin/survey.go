@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"net/http"
+
+	"connect-companion/bot/survey"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+)
+
+// surveyExport выгружает оценки: ?line=&from=&to=&format=csv|json
+func surveyExport(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	lines, ok := lineParams(c)
+	if !ok {
+		return
+	}
+	from, to, ok := periodParams(c)
+	if !ok {
+		return
+	}
+
+	results, err := survey.Query(db, lines, from, to)
+	if err != nil {
+		logger.Warning("Error while query survey results", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		c.Header("Content-Disposition", `attachment; filename="survey.csv"`)
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+
+		if err = survey.WriteCSV(c.Writer, results); err != nil {
+			logger.Warning("Error while write survey csv", err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// surveyStats считает сводку оценок: ?line=&from=&to=&group=spec|topic|day|line
+func surveyStats(c *gin.Context) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	lines, ok := lineParams(c)
+	if !ok {
+		return
+	}
+	from, to, ok := periodParams(c)
+	if !ok {
+		return
+	}
+
+	results, err := survey.Query(db, lines, from, to)
+	if err != nil {
+		logger.Warning("Error while query survey results", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":  from,
+		"to":    to,
+		"total": survey.Aggregate(results, ""),
+		"group": survey.Aggregate(results, c.DefaultQuery("group", survey.GROUP_SPEC)),
+	})
+}
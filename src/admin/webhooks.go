@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"net/http"
+
+	"connect-companion/bot/events"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookDeadLetters показывает события, которые не удалось доставить
+func webhookDeadLetters(c *gin.Context) {
+	letters, err := events.DeadLetters()
+	if err != nil {
+		logger.Warning("Error while read dead letters", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, letters)
+}
+
+// webhookRetry повторяет доставку недоставленных событий
+func webhookRetry(c *gin.Context) {
+	retried, err := events.RetryDeadLetters()
+	if err != nil {
+		logger.Warning("Error while retry dead letters", err)
+
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"retried": retried})
+}
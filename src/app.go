@@ -10,10 +10,14 @@ import (
 	"syscall"
 	"time"
 
+	"connect-companion/admin"
 	"connect-companion/bot"
+	"connect-companion/bot/audit"
 	"connect-companion/bot/client"
+	"connect-companion/bot/events"
 	"connect-companion/config"
 	"connect-companion/database"
+	"connect-companion/health"
 	"connect-companion/logger"
 
 	"github.com/gin-gonic/gin"
@@ -32,6 +36,25 @@ func main() {
 
 	cnf.RunInDebug = *debug
 	cnf.FilesDir = *filesDir
+
+	switch flag.Arg(0) {
+	case "":
+	case "test":
+		os.Exit(runTests(flag.Args()[1:]))
+	case "simulate":
+		os.Exit(runSimulate(flag.Args()[1:]))
+	case "migrate":
+		os.Exit(runMigrate(flag.Args()[1:]))
+	case "lint":
+		os.Exit(runLint(flag.Args()[1:]))
+	case "diagram":
+		os.Exit(runDiagram(flag.Args()[1:]))
+	case "privacy":
+		os.Exit(runPrivacy(flag.Args()[1:]))
+	default:
+		log.Fatalf("Unknown command %q\n", flag.Arg(0))
+	}
+
 	config.GetConfig(*configFile, cnf)
 
 	logger.InitLogger(*debug)
@@ -43,13 +66,37 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	db := database.Connect(cnf.Database)
+	db, err := database.Connect(cnf.Database)
+	if err != nil {
+		log.Fatalf("Redis: %s\n", err)
+	}
 
 	app := gin.Default()
 	app.Use(config.Inject(cnf), database.Inject("db", db))
 
 	client.Configure(cnf)
+	if err := bot.Configure(cnf); err != nil {
+		log.Fatalf("Config: %s\n", err)
+	}
+	if err := bot.LogLint(cnf); err != nil {
+		log.Fatalf("Lint: %s\n", err)
+	}
+	if err := bot.ConfigureMiddleware(cnf); err != nil {
+		log.Fatalf("Middleware: %s\n", err)
+	}
+	audit.Configure(cnf, db)
+	if err := client.ConfigureMiddleware(cnf); err != nil {
+		log.Fatalf("Middleware: %s\n", err)
+	}
+
+	health.Init(app)
 	bot.InitHooks(app, cnf.Line)
+	admin.Init(app, cnf)
+
+	workers, stopWorkers := context.WithCancel(context.Background())
+	bot.StartPendingDelivery(workers, cnf, db)
+	events.Start(workers, cnf, db)
+	waitReconciler := bot.StartHookReconciler(workers, cnf)
 
 	srv := &http.Server{
 		Addr:    cnf.Server.Listen,
@@ -65,7 +112,7 @@ func main() {
 	logger.Info("Application started")
 
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
 	quit := make(chan int)
 
@@ -75,10 +122,21 @@ func main() {
 			switch sig {
 			// kill -SIGHUP XXXX
 			// kill -SIGINT XXXX or Ctrl+c
-			case syscall.SIGHUP, syscall.SIGINT:
-				logger.Info("Catch OS signal! Exiting...")
+			// kill -SIGTERM XXXX or systemctl stop connect-companion
+			case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM:
+				logger.Info("Catch OS signal", sig.String(), "- exiting...")
 
-				bot.DestroyHooks(cnf.Line)
+				// Новые push получают 503, начатые диалоги доводим до конца
+				if !bot.Drain(cnf.Server.DrainTimeout) {
+					logger.Warning("Drain timeout exceeded, some conversations are interrupted")
+				}
+
+				stopWorkers()
+				// Иначе реконсилер может установить хук заново сразу после удаления
+				waitReconciler()
+				if !cnf.Hooks.KeepOnShutdown {
+					bot.DestroyHooks(cnf.Line)
+				}
 
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
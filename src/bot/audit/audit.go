@@ -0,0 +1,263 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"connect-companion/bot/client"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	// Исходящие вызовы API Connect
+	ACTION_SEND           = "send"
+	ACTION_FILE           = "file"
+	ACTION_DROP_KEYBOARD  = "drop_keyboard"
+	ACTION_APPOINT        = "appoint"
+	ACTION_APPOINT_SPEC   = "appoint_spec"
+	ACTION_DROP_TREATMENT = "drop_treatment"
+	ACTION_HOOK_SET       = "hook_set"
+	ACTION_HOOK_DELETE    = "hook_delete"
+	ACTION_API            = "api"
+
+	// Push о закрытии обращения: кто закрыл - специалист, Connect по таймауту или сам бот
+	ACTION_TREATMENT_CLOSED = "treatment_closed"
+
+	ACTION_ADMIN          = "admin"
+	ACTION_PRIVACY_EXPORT = "privacy_export"
+	ACTION_PRIVACY_ERASE  = "privacy_erase"
+
+	RESULT_OK    = "ok"
+	RESULT_ERROR = "error"
+
+	DEFAULT_MAX_LEN     = 1000000
+	DEFAULT_QUERY_LIMIT = 1000
+	QUERY_PAGE          = 500
+)
+
+type (
+	// Entry - запись журнала: кто, что и с каким результатом сделал
+	Entry struct {
+		Id     string     `json:"id,omitempty" example:"1760000000000-0"`
+		Time   time.Time  `json:"time"`
+		Actor  string     `json:"actor" example:"admin:hr"`
+		Action string     `json:"action" example:"privacy_erase"`
+		UserId *uuid.UUID `json:"user_id,omitempty" format:"uuid"`
+		LineId *uuid.UUID `json:"line_id,omitempty" format:"uuid"`
+		// Сообщение пользователя, в ответ на которое действовал бот
+		MessageId *uuid.UUID `json:"message_id,omitempty" format:"uuid"`
+		Result    string     `json:"result" example:"ok"`
+		// HTTP-код ответа Connect или админки
+		Code    int                    `json:"code,omitempty" example:"200"`
+		Error   string                 `json:"error,omitempty"`
+		Details map[string]interface{} `json:"details,omitempty"`
+	}
+
+	// Filter - условия выборки. Пустые поля не ограничивают
+	Filter struct {
+		UserId *uuid.UUID
+		LineId *uuid.UUID
+		Action string
+		From   time.Time
+		To     time.Time
+		Limit  int
+	}
+)
+
+var (
+	maxLen int64 = DEFAULT_MAX_LEN
+
+	actions = map[string]string{
+		"/line/send/message/":   ACTION_SEND,
+		"/line/send/file/":      ACTION_FILE,
+		"/line/send/image/":     ACTION_FILE,
+		"/line/drop/keyboard/":  ACTION_DROP_KEYBOARD,
+		"/line/appoint/start/":  ACTION_APPOINT,
+		"/line/appoint/spec/":   ACTION_APPOINT_SPEC,
+		"/line/drop/treatment/": ACTION_DROP_TREATMENT,
+		"/hook/":                ACTION_HOOK_SET,
+	}
+)
+
+// Журнал - поток Redis: записи только добавляются, а идентификаторы упорядочены по времени
+func streamKey() string {
+	return database.PREFIX_AUDIT + "log"
+}
+
+// Configure задает размер журнала и начинает записывать исходящие вызовы API Connect.
+// Вызывается до client.ConfigureMiddleware, чтобы в журнал попадал итог всей цепочки
+func Configure(cnf *config.Conf, db redis.UniversalClient) {
+	if cnf.Audit.MaxLen > 0 {
+		maxLen = cnf.Audit.MaxLen
+	}
+
+	client.Use(clientMiddleware(db))
+}
+
+// Record добавляет запись в журнал. Самые старые записи вытесняются после max_len
+func Record(db redis.UniversalClient, entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return db.XAdd(&redis.XAddArgs{
+		Stream:       streamKey(),
+		MaxLenApprox: maxLen,
+		Values:       map[string]interface{}{"entry": data},
+	}).Err()
+}
+
+// clientMiddleware записывает каждый исходящий вызов с его инициатором и результатом
+func clientMiddleware(db redis.UniversalClient) client.Middleware {
+	return func(next client.Invoker) client.Invoker {
+		return func(call *client.Call) ([]byte, error) {
+			content, err := next(call)
+
+			entry := Entry{Actor: client.ACTOR_BOT, Action: callAction(call), Result: RESULT_OK, Code: call.Status}
+			if origin := call.Origin; origin != nil {
+				if origin.Actor != "" {
+					entry.Actor = origin.Actor
+				}
+				entry.LineId = optional(origin.LineId)
+				entry.UserId = optional(origin.UserId)
+				entry.MessageId = optional(origin.MessageId)
+			}
+			if entry.Action == ACTION_API {
+				entry.Details = map[string]interface{}{"method": call.Method, "url": call.Url}
+			}
+			if err != nil {
+				entry.Result, entry.Error = RESULT_ERROR, err.Error()
+
+				var httpErr *client.HttpError
+				if errors.As(err, &httpErr) && entry.Code == 0 {
+					entry.Code = httpErr.Code
+				}
+			}
+
+			if auditErr := Record(db, entry); auditErr != nil {
+				logger.Warning("Error while record audit", auditErr)
+			}
+
+			return content, err
+		}
+	}
+}
+
+func callAction(call *client.Call) string {
+	if call.Method == "DELETE" && strings.HasPrefix(call.Url, "/hook/") {
+		return ACTION_HOOK_DELETE
+	}
+	if action, ok := actions[call.Url]; ok {
+		return action
+	}
+
+	return ACTION_API
+}
+
+func optional(id uuid.UUID) *uuid.UUID {
+	if id == uuid.Nil {
+		return nil
+	}
+
+	return &id
+}
+
+// Query возвращает записи по условиям, сначала новые
+func Query(db redis.UniversalClient, filter Filter) ([]Entry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DEFAULT_QUERY_LIMIT
+	}
+
+	start, end := "-", "+"
+	if !filter.From.IsZero() {
+		start = strconv.FormatInt(filter.From.UnixNano()/int64(time.Millisecond), 10)
+	}
+	if !filter.To.IsZero() {
+		end = strconv.FormatInt(filter.To.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	entries := []Entry{}
+	for {
+		page, err := db.XRevRangeN(streamKey(), end, start, QUERY_PAGE).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range page {
+			raw, _ := message.Values["entry"].(string)
+
+			var entry Entry
+			if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+				logger.Warning("Error while decoding audit entry", message.ID, err)
+				continue
+			}
+			entry.Id = message.ID
+
+			if filter.match(&entry) {
+				entries = append(entries, entry)
+				if len(entries) == limit {
+					return entries, nil
+				}
+			}
+		}
+
+		if len(page) < QUERY_PAGE {
+			return entries, nil
+		}
+		if end = before(page[len(page)-1].ID); end == "" {
+			return entries, nil
+		}
+	}
+}
+
+// ForUser возвращает все записи журнала о пользователе, начиная с последних
+func ForUser(db redis.UniversalClient, userId uuid.UUID) ([]Entry, error) {
+	return Query(db, Filter{UserId: &userId, Limit: math.MaxInt32})
+}
+
+func (filter *Filter) match(entry *Entry) bool {
+	if filter.UserId != nil && (entry.UserId == nil || *entry.UserId != *filter.UserId) {
+		return false
+	}
+	if filter.LineId != nil && (entry.LineId == nil || *entry.LineId != *filter.LineId) {
+		return false
+	}
+
+	return filter.Action == "" || entry.Action == filter.Action
+}
+
+// before возвращает наибольший идентификатор потока, меньший id, или пустую строку
+func before(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+
+	ms, err1 := strconv.ParseUint(parts[0], 10, 64)
+	seq, err2 := strconv.ParseUint(parts[1], 10, 64)
+	switch {
+	case err1 != nil || err2 != nil:
+		return ""
+	case seq > 0:
+		return parts[0] + "-" + strconv.FormatUint(seq-1, 10)
+	case ms > 0:
+		return strconv.FormatUint(ms-1, 10) + "-" + strconv.FormatUint(math.MaxUint64, 10)
+	}
+
+	return ""
+}
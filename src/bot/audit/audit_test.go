@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"net/http"
+	"testing"
+
+	"connect-companion/bot/client"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+func TestBefore(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"1760000000000-5", "1760000000000-4"},
+		{"1760000000000-0", "1759999999999-18446744073709551615"},
+		{"1-0", "0-18446744073709551615"},
+		{"0-1", "0-0"},
+		{"0-0", ""},
+		{"1760000000000", ""},
+		{"x-1", ""},
+	}
+
+	for _, test := range tests {
+		if got := before(test.id); got != test.want {
+			t.Errorf("before(%q) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}
+
+func TestClientMiddlewareCode(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mini.Close()
+	db := redis.NewClient(&redis.Options{Addr: mini.Addr()})
+
+	tests := []struct {
+		status int
+		err    error
+		result string
+	}{
+		{http.StatusOK, nil, RESULT_OK},
+		{http.StatusNoContent, nil, RESULT_OK},
+		{http.StatusNotFound, &client.HttpError{Code: http.StatusNotFound}, RESULT_ERROR},
+		{0, &client.HttpError{Code: http.StatusBadGateway}, RESULT_ERROR},
+	}
+
+	for _, test := range tests {
+		userId := uuid.New()
+		invoke := clientMiddleware(db)(func(call *client.Call) ([]byte, error) {
+			call.Status = test.status
+			return nil, test.err
+		})
+		_, _ = invoke(&client.Call{Method: "POST", Url: "/line/send/message/", Origin: &client.Origin{UserId: userId}})
+
+		entries, err := ForUser(db, userId)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("status %d: got %v, %v, want one entry", test.status, entries, err)
+		}
+
+		want := test.status
+		if want == 0 {
+			want = test.err.(*client.HttpError).Code
+		}
+		if entry := entries[0]; entry.Code != want || entry.Result != test.result {
+			t.Errorf("status %d: got code %d, result %s, want %d, %s", test.status, entry.Code, entry.Result, want, test.result)
+		}
+	}
+}
@@ -1,15 +1,16 @@
 package bot
 
 import (
-	"encoding/json"
 	"errors"
 	"net/http"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"connect-companion/bot/client"
+	"connect-companion/bot/events"
+	"connect-companion/bot/experiments"
+	"connect-companion/bot/flood"
 	"connect-companion/bot/messages"
-	"connect-companion/bot/requests"
 	"connect-companion/config"
 	"connect-companion/database"
 	"connect-companion/logger"
@@ -24,11 +25,39 @@ const (
 	BOT_PHRASE_FILE_SENDING = "Сейчас пришлю соотвествующий файл, подождите."
 	BOT_PHRASE_FILE_SENDED  = "Вот, пожалуйста."
 	BOT_PHRASE_AGAIN        = "Могу ли я чем-то помочь еще?"
+	BOT_PHRASE_DOCUMENTS    = "Выберите документ:"
 	BOT_PHRASE_RETOUTING    = "Сейчас переведу, секундочку."
 	BOT_PHRASE_BYE          = "Спасибо за обращение!"
+
+	BOT_PHRASE_SICK_LEAVE          = "Прикрепите, пожалуйста, скан или фото больничного листа."
+	BOT_PHRASE_FILE_RECEIVED       = "Спасибо, файл получен и передан в отдел кадров."
+	BOT_PHRASE_FILE_TOO_LARGE      = "Файл слишком большой. Пришлите, пожалуйста, файл поменьше."
+	BOT_PHRASE_FILE_TYPE_REJECTED  = "Такой тип файла не подходит. Пришлите, пожалуйста, PDF, JPG или PNG."
+	BOT_PHRASE_FILE_RECEIVE_FAILED = "Не получилось принять файл. Попробуйте отправить его еще раз."
+	BOT_PHRASE_FILE_SEND_FAILED    = "К сожалению, не удалось отправить файл. Выберите, пожалуйста, другой вариант:"
+
+	BOT_PHRASE_OFF_HOURS         = "Сейчас специалисты не работают, они будут на связи %s. Хотите оставить сообщение? Мы передадим его, как только линия откроется."
+	BOT_PHRASE_OFF_HOURS_UNKNOWN = "Сейчас специалисты не работают. Хотите оставить сообщение? Мы передадим его, как только линия откроется."
+	BOT_PHRASE_LEAVE_MESSAGE     = "Напишите, пожалуйста, ваше сообщение одним текстом."
+	BOT_PHRASE_MESSAGE_LEFT      = "Спасибо! Передадим ваше сообщение специалисту, как только линия откроется."
+	BOT_PHRASE_MESSAGE_NOT_LEFT  = "Не получилось сохранить сообщение. Попробуйте, пожалуйста, еще раз."
+	BOT_PHRASE_PENDING_DELIVERED = "Сообщение, оставленное в нерабочее время:\n%s"
+
+	BOT_PHRASE_SURVEY         = "Оцените, пожалуйста, как мы помогли вам: от 1 (плохо) до 5 (отлично)."
+	BOT_PHRASE_SURVEY_COMMENT = "Спасибо! Хотите что-то добавить? Напишите комментарий или нажмите «Пропустить»."
+	BOT_PHRASE_SURVEY_THANKS  = "Спасибо за оценку!"
+
+	BOT_PHRASE_PROFANITY = "Давайте общаться вежливо."
+	BOT_PHRASE_SLOW_DOWN = "Вы пишете слишком часто. Пожалуйста, подождите немного и повторите последнее сообщение."
 )
 
 func Receive(c *gin.Context) {
+	// Бот останавливается: новые диалоги не начинаем, чтобы не оборвать их на середине
+	if Draining() {
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+
 	var msg messages.Message
 	if err := c.BindJSON(&msg); err != nil {
 		logger.Warning("Error while receive message", err)
@@ -45,26 +74,67 @@ func Receive(c *gin.Context) {
 		return
 	}
 
+	// Флуд и черный список отсекаем до запуска обработки, чтобы поток сообщений
+	// не порождал горутины и чтения состояния
+	verdict := Admit(c, &msg)
+	if verdict == flood.DROP {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if !track() {
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+
 	cCp := c.Copy()
 	go func(cCp *gin.Context, msg messages.Message) {
-		chatState := getState(c, &msg)
+		defer untrack()
 
-		newState, err := processMessage(c, &msg, &chatState)
-		if err != nil {
-			logger.Warning("Error processMessage", err)
+		if verdict == flood.SLOW_DOWN {
+			_ = SlowDown(cCp, &msg)
+			return
 		}
 
-		err = changeState(c, &msg, &chatState, newState)
-		if err != nil {
-			logger.Warning("Error changeState", err)
-		}
+		_ = Dispatch(cCp, &msg)
 	}(cCp, msg)
 
 	c.Status(http.StatusOK)
 }
 
-func getState(c *gin.Context, msg *messages.Message) database.Chat {
-	db := c.MustGet("db").(*redis.Client)
+// Dispatch обрабатывает сообщение синхронно: читает состояние чата, пропускает
+// сообщение через middleware и сохраняет новое состояние
+func Dispatch(c *gin.Context, msg *messages.Message) error {
+	chatState, err := getState(c, msg)
+	if err != nil {
+		return nil
+	}
+	assigned := assignExperiments(msg, &chatState)
+
+	newState, err := pipeline(&Context{Gin: c, Message: msg, Chat: &chatState})
+	if err == ErrIgnore {
+		return nil
+	}
+	if err != nil {
+		logger.Warning("Error processMessage", err)
+	}
+
+	err = changeState(c, msg, &chatState, newState)
+	if err != nil {
+		logger.Warning("Error changeState", err)
+
+		return err
+	}
+
+	countVariants(c, assigned, experiments.METRIC_CHATS)
+
+	return nil
+}
+
+// getState читает состояние чата. Ошибка - только database.ErrChatNewer: такой чат
+// ведет экземпляр с новой схемой, сообщение пропускаем, а запись не трогаем
+func getState(c *gin.Context, msg *messages.Message) (database.Chat, error) {
+	db := c.MustGet("db").(redis.UniversalClient)
 
 	var chatState database.Chat
 
@@ -81,22 +151,43 @@ func getState(c *gin.Context, msg *messages.Message) database.Chat {
 	} else if err != nil {
 		logger.Warning("Error while reading state from redis", err)
 	} else {
-		err = json.Unmarshal(dbStateRaw, &chatState)
-		if err != nil {
-			logger.Warning("Error while decoding state", err)
+		var from int
+		chatState, from, err = database.DecodeChat(dbStateRaw)
+		if errors.Is(err, database.ErrChatNewer) {
+			logger.Warning("State of "+msg.UserId.String()+":"+msg.LineId.String()+" is left as is, message skipped:", err)
+
+			return chatState, err
+		} else if err != nil {
+			// Непонятную запись не угадываем, а начинаем диалог заново
+			logger.Warning("Error while decoding state of "+msg.UserId.String()+":"+msg.LineId.String()+", start over:", err)
+
+			chatState = database.Chat{
+				PreviousState: database.STATE_GREETINGS,
+				CurrentState:  database.STATE_GREETINGS,
+			}
+		} else if from != database.ChatVersion() {
+			logger.Debug("State migrated from version", from)
 		}
 	}
 
-	return chatState
+	return chatState, nil
 }
 
 func changeState(c *gin.Context, msg *messages.Message, chatState *database.Chat, toState database.ChatState) error {
-	db := c.MustGet("db").(*redis.Client)
+	db := c.MustGet("db").(redis.UniversalClient)
 
-	chatState.PreviousState = chatState.CurrentState
+	from := chatState.CurrentState
+	chatState.PreviousState = from
 	chatState.CurrentState = toState
 
-	data, err := json.Marshal(chatState)
+	// Диалог начинается заново - история навигации и ответы форм больше не нужны
+	if toState == database.STATE_GREETINGS {
+		chatState.History = nil
+		chatState.Form = nil
+		chatState.Vars = nil
+	}
+
+	data, err := database.EncodeChat(chatState)
 	if err != nil {
 		logger.Warning("Error while change state to db", err)
 
@@ -109,107 +200,99 @@ func changeState(c *gin.Context, msg *messages.Message, chatState *database.Chat
 	logger.Debug("Write state to db result", result)
 	if err != nil {
 		logger.Warning("Error while write state to db", err)
+
+		return err
+	}
+
+	// Событие - только о сохраненном переходе, повторный показ состояния переходом не считается
+	if from != toState {
+		events.Emit(events.New(events.STATE_CHANGED, msg.LineId, msg.UserId, map[string]interface{}{
+			"from":  from,
+			"to":    toState,
+			"topic": chatState.Topic,
+		}))
 	}
 
 	return nil
 }
 
 func processMessage(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
-	cnf := c.MustGet("cnf").(*config.Conf)
-
-	keyboardMain := &[][]requests.KeyboardKey{
-		{{Id: "1", Text: "Памятка сотрудника"}},
-		{{Id: "2", Text: "Положение о персонале"}},
-		{{Id: "3", Text: "Регламент о пожеланиях"}},
-		{{Id: "9", Text: "Закрыть обращение"}},
-		{{Id: "0", Text: "Перевести на специалиста"}},
-	}
-	keyboardParting := &[][]requests.KeyboardKey{
-		{{Id: "1", Text: "Да"}, {Id: "2", Text: "Нет"}},
-		{{Id: "0", Text: "Перевести на специалиста"}},
-	}
-
 	switch msg.MessageType {
 	case messages.MESSAGE_TREATMENT_START_BY_USER:
 		return chatState.CurrentState, nil
+	case messages.MESSAGE_TREATMENT_CLOSE:
+		return treatmentClosed(c, msg, chatState)
 	case messages.MESSAGE_CALL_START_TREATMENT,
 		messages.MESSAGE_CALL_START_NO_TREATMENT,
 		messages.MESSAGE_TREATMENT_START_BY_SPEC,
-		messages.MESSAGE_TREATMENT_CLOSE,
 		messages.MESSAGE_TREATMENT_CLOSE_ACTIVE:
 
+		chatState.Topic = ""
+
 		return msg.Start(database.STATE_GREETINGS)
 	case messages.MESSAGE_TREATMENT_TO_BOT:
 		// Спец перевел на бота. Смотрим куда именно
 		switch msg.Data.Redirect {
 		case "add_collegue,level:1":
 			// return msg.Send("Как добавить сотрудника в 1с-коннект?\n"+BOT_PHRASE_DEMO_0, database.STATE_DEMO_1, keyboardDemo1)
-			return msg.Send(c, BOT_PHRASE_GREETING, database.STATE_MAIN_MENU, keyboardMain)
+			return toMainMenu(c, msg, chatState)
 		case "add_collegue,level:3":
 			// filePath, _ := filepath.Abs(filepath.Join(cnf.FilesDir, "manage_spec.png"))
-			// return msg.SendFile(true, "manage_spec.png", filePath, BOT_PHRASE_DEMO_2, database.STATE_DEMO_3, keyboardDemo3)
-			return msg.Send(c, BOT_PHRASE_GREETING, database.STATE_MAIN_MENU, keyboardMain)
+			// return msg.SendFile(c, "manage_spec.png", filePath, BOT_PHRASE_DEMO_2, database.STATE_DEMO_3, keyboardDemo3)
+			return toMainMenu(c, msg, chatState)
 		default:
-			return msg.Send(c, BOT_PHRASE_GREETING, database.STATE_MAIN_MENU, keyboardMain)
+			return toMainMenu(c, msg, chatState)
 		}
 	case messages.MESSAGE_TEXT:
-		text := strings.ToLower(strings.TrimSpace(msg.Text))
+		return handleText(c, msg, chatState)
+	case messages.MESSAGE_FILE:
+		// Файл ждем не везде: вне ожидающих его состояний переводим на специалиста
+		if state, ok := states[chatState.CurrentState]; ok && state.OnFile != nil {
+			return state.OnFile(c, msg, chatState)
+		}
 
-		switch chatState.CurrentState {
-		case database.STATE_DUMMY, database.STATE_GREETINGS:
-			return msg.Send(c, BOT_PHRASE_GREETING, database.STATE_MAIN_MENU, keyboardMain)
-		case database.STATE_MAIN_MENU:
-			comment := BOT_PHRASE_FILE_SENDED
-			switch text {
-			case "1", "памятка сотрудника":
-				msg.Send(c, BOT_PHRASE_FILE_SENDING, database.STATE_PARTING, nil)
+		countOutcome(c, chatState, experiments.METRIC_REROUTED)
 
-				filePath, _ := filepath.Abs(filepath.Join(cnf.FilesDir, "Памятка сотрудника.pdf"))
-				msg.SendFile(c, false, "Памятка сотрудника.pdf", filePath, &comment, database.STATE_PARTING, nil)
+		if !isLineOpen(msg.LineId) {
+			msg.Start(database.STATE_OFF_HOURS)
 
-				time.Sleep(3 * time.Second)
+			return offerLeaveMessage(c, msg, chatState)
+		}
 
-				return msg.Send(c, BOT_PHRASE_AGAIN, database.STATE_PARTING, keyboardParting)
-			case "2", "положение о персонале":
-				msg.Send(c, BOT_PHRASE_FILE_SENDING, database.STATE_PARTING, nil)
+		msg.Start(database.STATE_GREETINGS)
 
-				filePath, _ := filepath.Abs(filepath.Join(cnf.FilesDir, "Положение о персонале.pdf"))
-				msg.SendFile(c, false, "Положение о персонале.pdf", filePath, &comment, database.STATE_PARTING, nil)
+		return appoint(c, msg, chatState.Topic)
+	}
 
-				time.Sleep(3 * time.Second)
+	return database.STATE_DUMMY, errors.New("I don't know hat i mus do!")
+}
 
-				return msg.Send(c, BOT_PHRASE_AGAIN, database.STATE_PARTING, keyboardParting)
-			case "3", "регламент о пожеланиях":
-				msg.Send(c, BOT_PHRASE_FILE_SENDING, database.STATE_PARTING, nil)
+// sendDocument отправляет пользователю файл из FilesDir и предлагает продолжить.
+// При ошибке отправки повторяет текущее меню.
+func sendDocument(fileName string) Action {
+	return func(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+		cnf := c.MustGet("cnf").(*config.Conf)
 
-				filePath, _ := filepath.Abs(filepath.Join(cnf.FilesDir, "Регламент.pdf"))
-				msg.SendFile(c, false, "Регламент.pdf", filePath, &comment, database.STATE_PARTING, nil)
+		caption, ok := captions[fileName]
+		if !ok {
+			caption = BOT_PHRASE_FILE_SENDED
+		}
+		comment := render(c, msg, chatState, caption)
 
-				time.Sleep(3 * time.Second)
+		msg.Send(c, BOT_PHRASE_FILE_SENDING, chatState.CurrentState, nil)
 
-				return msg.Send(c, BOT_PHRASE_AGAIN, database.STATE_PARTING, keyboardParting)
-			case "9", "закрыть обращение":
-				return msg.CloseTreatment(c, BOT_PHRASE_BYE, database.STATE_GREETINGS)
-			case "0", "перевести на специалиста":
-				return msg.RerouteTreatment(c, BOT_PHRASE_RETOUTING, database.STATE_GREETINGS)
-			default:
-				return msg.Send(c, BOT_PHRASE_SORRY, database.STATE_MAIN_MENU, keyboardMain)
-			}
-		case database.STATE_PARTING:
-			switch text {
-			case "1", "да":
-				return msg.Send(c, BOT_PHRASE_GREETING, database.STATE_MAIN_MENU, keyboardMain)
-			case "2", "нет":
-				return msg.CloseTreatment(c, BOT_PHRASE_BYE, database.STATE_GREETINGS)
-			case "0", "перевести на специалиста":
-				return msg.RerouteTreatment(c, BOT_PHRASE_RETOUTING, database.STATE_GREETINGS)
-			default:
-				return msg.Send(c, BOT_PHRASE_SORRY, database.STATE_PARTING, keyboardParting)
+		filePath, _ := filepath.Abs(filepath.Join(cnf.FilesDir, fileName))
+		_, err := msg.SendFile(c, fileName, filePath, &comment, database.STATE_PARTING, nil)
+		if err != nil {
+			if errors.Is(err, client.ErrFileTooLarge) {
+				logger.Warning("File", filePath, "exceeds max_file_size, check configuration")
 			}
+
+			return show(c, msg, chatState, states[chatState.CurrentState], BOT_PHRASE_FILE_SEND_FAILED)
 		}
-	case messages.MESSAGE_FILE:
-		return msg.StartAndReroute(database.STATE_GREETINGS)
-	}
 
-	return database.STATE_DUMMY, errors.New("I don't know hat i mus do!")
+		messages.Pause(3 * time.Second)
+
+		return enter(c, msg, chatState, database.STATE_PARTING)
+	}
 }
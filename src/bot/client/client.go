@@ -2,10 +2,14 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -24,6 +28,13 @@ func Configure(c *config.Conf) {
 	cnf = c
 }
 
+const (
+	// Загрузка файла: к этому времени добавляется время передачи со скоростью
+	// не ниже UPLOAD_MIN_RATE байт в секунду
+	UPLOAD_BASE_TIMEOUT = 20 * time.Second
+	UPLOAD_MIN_RATE     = 128 << 10
+)
+
 var (
 	client = &http.Client{
 		Timeout: 20 * time.Second,
@@ -34,6 +45,28 @@ var (
 			DisableCompression:  true,
 		},
 	}
+
+	// Для загрузки файлов: общий таймаут клиента ограничил бы и передачу тела,
+	// поэтому срок задается для каждого запроса по размеру файла
+	uploadClient = &http.Client{
+		Transport: client.Transport,
+	}
+
+	// Для файлов: тот же транспорт, но перенаправления только на разрешенные хосты
+	downloadClient = &http.Client{
+		Timeout:   client.Timeout,
+		Transport: client.Transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !downloadAllowed(req.URL) {
+				return ErrDownloadForeign
+			}
+
+			return nil
+		},
+	}
 )
 
 type (
@@ -44,6 +77,16 @@ type (
 	}
 )
 
+const (
+	// ACTOR_BOT - действие бота в ответ на сообщение пользователя или по расписанию
+	ACTOR_BOT = "bot"
+)
+
+var (
+	ErrFileTooLarge    = errors.New("file exceeds size limit")
+	ErrDownloadForeign = errors.New("file host is not allowed")
+)
+
 func (e *HttpError) Error() string {
 	return fmt.Sprintf("Http request failed for %s with code %d and message:\n%s", e.Url, e.Code, e.Message)
 }
@@ -77,33 +120,101 @@ func SetHook(lineId uuid.UUID) (content []byte, err error) {
 	}
 	jsonData, err := json.Marshal(data)
 
-	return Invoke("POST", "/hook/", "application/json", jsonData)
+	return InvokeFrom(hookOrigin(lineId), "POST", "/hook/", "application/json", jsonData)
+}
+
+// HookRegistered проверяет, что на линии установлен хук бота с нашим адресом.
+// Хука нет - Connect отвечает 404
+func HookRegistered(lineId uuid.UUID) (bool, error) {
+	content, err := InvokeFrom(hookOrigin(lineId), "GET", "/hook/bot/"+lineId.String()+"/", "application/json", nil)
+	if httpErr, ok := err.(*HttpError); ok && httpErr.Code == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var hook requests.HookSetupRequest
+	if err = json.Unmarshal(content, &hook); err != nil {
+		return false, err
+	}
+
+	return hook.Url == "" || hook.Url == cnf.Server.Host+"/connect-push/receive/", nil
 }
 
 func DeleteHook(lineId uuid.UUID) (content []byte, err error) {
-	return Invoke("DELETE", "/hook/bot/"+lineId.String()+"/", "application/json", nil)
+	return InvokeFrom(hookOrigin(lineId), "DELETE", "/hook/bot/"+lineId.String()+"/", "application/json", nil)
+}
+
+func hookOrigin(lineId uuid.UUID) *Origin {
+	return &Origin{Actor: ACTOR_BOT, LineId: lineId}
 }
 
 func Invoke(method string, methodUrl string, contentType string, body []byte) (content []byte, err error) {
-	methodUrl = strings.Trim(methodUrl, "/")
-	reqUrl := cnf.Connect.Server + "/v1/" + methodUrl + "/"
+	return InvokeFrom(nil, method, methodUrl, contentType, body)
+}
 
-	req, err := http.NewRequest(method, reqUrl, bytes.NewBuffer(body))
+// InvokeFrom вызывает метод API Connect от имени origin
+func InvokeFrom(origin *Origin, method string, methodUrl string, contentType string, body []byte) (content []byte, err error) {
+	return InvokeStreamFrom(origin, method, methodUrl, contentType, bytes.NewReader(body), 0)
+}
+
+// InvokeStream вызывает метод API Connect, читая тело запроса из body по мере отправки.
+// size - примерный размер тела: по нему рассчитывается срок загрузки, 0 - обычный таймаут
+func InvokeStream(method string, methodUrl string, contentType string, body io.Reader, size int64) (content []byte, err error) {
+	return InvokeStreamFrom(nil, method, methodUrl, contentType, body, size)
+}
+
+// InvokeStreamFrom - InvokeStream от имени origin
+func InvokeStreamFrom(origin *Origin, method string, methodUrl string, contentType string, body io.Reader, size int64) (content []byte, err error) {
+	return transport(&Call{
+		Method:      method,
+		Url:         "/" + strings.Trim(methodUrl, "/") + "/",
+		ContentType: contentType,
+		Body:        body,
+		Size:        size,
+		Origin:      origin,
+	})
+}
+
+// uploadTimeout - срок загрузки тела размером size
+func uploadTimeout(size int64) time.Duration {
+	return UPLOAD_BASE_TIMEOUT + time.Duration(size/UPLOAD_MIN_RATE)*time.Second
+}
+
+// send выполняет вызов на сервере Connect - последнее звено цепочки middleware
+func send(call *Call) (content []byte, err error) {
+	reqUrl := cnf.Connect.Server + "/v1" + call.Url
+
+	req, err := http.NewRequest(call.Method, reqUrl, call.Body)
 	if err != nil {
-		logger.Warning("Error while create request for", reqUrl, "with method", method, ":", err)
+		logger.Warning("Error while create request for", reqUrl, "with method", call.Method, ":", err)
+
+		return nil, err
 	}
 
 	req.SetBasicAuth(cnf.Connect.Login, cnf.Connect.Password)
-	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Type", call.ContentType)
 
 	logger.Debug("---> request", req.Method, reqUrl)
 
-	resp, err := client.Do(req)
+	httpClient := client
+	if call.Size > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout(call.Size))
+		defer cancel()
+
+		req = req.WithContext(ctx)
+		httpClient = uploadClient
+	}
+
+	resp, err := httpClient.Do(req)
 
 	if err != nil {
+		report(err)
+
 		return nil, err
 	} else {
 		defer resp.Body.Close()
+		call.Status = resp.StatusCode
 		bodyBytes, err := ioutil.ReadAll(resp.Body)
 		logger.Debug("<--- request", req.Method, reqUrl, "with body", bodyBytes)
 		if err != nil {
@@ -111,13 +222,93 @@ func Invoke(method string, methodUrl string, contentType string, body []byte) (c
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			return nil, &HttpError{
+			err := &HttpError{
 				Url:     req.URL.String(),
 				Code:    resp.StatusCode,
 				Message: string(bodyBytes),
 			}
+			report(err)
+
+			return nil, err
 		}
 
+		report(nil)
+
 		return bodyBytes, nil
 	}
 }
+
+// Download скачивает файл в w. Относительный путь считается методом API Connect,
+// авторизация передается только на сервер Connect. Абсолютный адрес и перенаправления
+// допускаются только на сервер Connect и хосты из uploads.allowed_hosts
+func Download(fileUrl string, w io.Writer, limit int64) (written int64, err error) {
+	return download(fileUrl, w, limit)
+}
+
+// downloadAllowed - можно ли скачивать с этого адреса
+func downloadAllowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	if server, err := url.Parse(cnf.Connect.Server); err == nil && server.Scheme == u.Scheme && strings.EqualFold(server.Host, u.Host) {
+		return true
+	}
+	for _, host := range cnf.Uploads.AllowedHosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func httpDownload(fileUrl string, w io.Writer, limit int64) (written int64, err error) {
+	if !strings.HasPrefix(fileUrl, "http://") && !strings.HasPrefix(fileUrl, "https://") {
+		fileUrl = cnf.Connect.Server + "/v1/" + strings.Trim(fileUrl, "/") + "/"
+	}
+
+	req, err := http.NewRequest("GET", fileUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !downloadAllowed(req.URL) {
+		logger.Warning("Refuse to download from", req.URL.Host)
+
+		return 0, ErrDownloadForeign
+	}
+
+	if strings.HasPrefix(fileUrl, cnf.Connect.Server+"/") {
+		req.SetBasicAuth(cnf.Connect.Login, cnf.Connect.Password)
+	}
+
+	logger.Debug("---> download", fileUrl)
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+		return 0, &HttpError{
+			Url:     req.URL.String(),
+			Code:    resp.StatusCode,
+			Message: string(bodyBytes),
+		}
+	}
+
+	written, err = io.Copy(w, io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return written, err
+	}
+	if written > limit {
+		return written, ErrFileTooLarge
+	}
+
+	logger.Debug("<--- download", fileUrl, "bytes", written)
+
+	return written, nil
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"connect-companion/config"
+)
+
+func TestDownloadAllowed(t *testing.T) {
+	defer Configure(cnf)
+
+	c := &config.Conf{}
+	c.Connect.Server = "https://connect.example.com"
+	c.Uploads.AllowedHosts = []string{"files.example.com"}
+	Configure(c)
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://connect.example.com/v1/line/file/1/", true},
+		{"https://CONNECT.example.com/v1/line/file/1/", true},
+		{"http://connect.example.com/v1/line/file/1/", false},
+		{"https://connect.example.com.evil.com/file", false},
+		{"https://files.example.com:8443/abc", true},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://localhost:6379/", false},
+		{"file:///etc/passwd", false},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := downloadAllowed(u); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestUploadTimeout(t *testing.T) {
+	tests := []struct {
+		size int64
+		want time.Duration
+	}{
+		{0, UPLOAD_BASE_TIMEOUT},
+		{100 << 10, UPLOAD_BASE_TIMEOUT},
+		{1 << 20, UPLOAD_BASE_TIMEOUT + 8*time.Second},
+		{50 << 20, UPLOAD_BASE_TIMEOUT + 400*time.Second},
+	}
+
+	for _, test := range tests {
+		if got := uploadTimeout(test.size); got != test.want {
+			t.Errorf("%d bytes: got %v, want %v", test.size, got, test.want)
+		}
+	}
+
+	if client.Timeout != 20*time.Second || uploadClient.Timeout != 0 {
+		t.Errorf("got client timeout %v and upload timeout %v, want 20s and none", client.Timeout, uploadClient.Timeout)
+	}
+}
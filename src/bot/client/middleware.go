@@ -0,0 +1,132 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"connect-companion/config"
+	"connect-companion/logger"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Call - исходящий вызов метода API Connect
+	Call struct {
+		Method      string
+		Url         string
+		ContentType string
+		Body        io.Reader
+		// Size - размер тела для загрузки файлов, 0 - обычный вызов
+		Size int64
+		// Origin - кто и в ответ на что делает вызов, если известно
+		Origin *Origin
+		// Status - HTTP-код ответа, заполняет транспорт. 0 - ответа не было
+		Status int
+	}
+
+	// Origin - инициатор исходящего вызова: чат, сообщение, на которое отвечает бот,
+	// и кто действует (бот, администратор, фоновая задача)
+	Origin struct {
+		Actor     string
+		LineId    uuid.UUID
+		UserId    uuid.UUID
+		MessageId uuid.UUID
+	}
+
+	Invoker func(call *Call) ([]byte, error)
+
+	// Downloader скачивает файл по адресу из push-сообщения
+	Downloader func(fileUrl string, w io.Writer, limit int64) (int64, error)
+
+	// Middleware оборачивает исходящие вызовы API: может изменить запрос,
+	// подменить ответ или не выполнять вызов вовсе
+	Middleware func(next Invoker) Invoker
+)
+
+var (
+	middlewares      []Middleware
+	namedMiddlewares = map[string]Middleware{
+		"logging": loggingMiddleware,
+	}
+
+	base      Invoker = send
+	transport Invoker = send
+
+	download Downloader = httpDownload
+)
+
+// Use добавляет middleware в цепочку исходящих вызовов. Добавленные раньше выполняются раньше
+func Use(m ...Middleware) {
+	middlewares = append(middlewares, m...)
+	rebuild()
+}
+
+// SetTransport подменяет отправку запросов на сервер Connect, например записью вызовов
+// при прогоне сценариев. Middleware продолжают работать. Возвращает функцию отмены
+func SetTransport(invoker Invoker) (restore func()) {
+	prev := base
+	base = invoker
+	rebuild()
+
+	return func() {
+		base = prev
+		rebuild()
+	}
+}
+
+// SetDownloader подменяет скачивание файлов. Возвращает функцию отмены
+func SetDownloader(downloader Downloader) (restore func()) {
+	prev := download
+	download = downloader
+
+	return func() {
+		download = prev
+	}
+}
+
+func rebuild() {
+	transport = base
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		transport = middlewares[i](transport)
+	}
+}
+
+// RegisterMiddleware делает middleware доступным по имени в конфигурации
+func RegisterMiddleware(name string, m Middleware) {
+	if _, ok := namedMiddlewares[name]; ok {
+		panic("client: middleware " + name + " already registered")
+	}
+
+	namedMiddlewares[name] = m
+}
+
+// ConfigureMiddleware добавляет в цепочку middleware, перечисленные в конфигурации
+func ConfigureMiddleware(cnf *config.Conf) error {
+	for _, name := range cnf.Middleware.Outbound {
+		m, ok := namedMiddlewares[name]
+		if !ok {
+			return fmt.Errorf("unknown outbound middleware %q", name)
+		}
+
+		Use(m)
+	}
+
+	return nil
+}
+
+func loggingMiddleware(next Invoker) Invoker {
+	return func(call *Call) ([]byte, error) {
+		started := time.Now()
+
+		content, err := next(call)
+		if err != nil {
+			logger.Warning("API", call.Method, call.Url, "failed in", time.Since(started).Round(time.Millisecond), ":", err)
+		} else {
+			logger.Info("API", call.Method, call.Url, "done in", time.Since(started).Round(time.Millisecond))
+		}
+
+		return content, err
+	}
+}
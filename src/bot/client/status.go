@@ -0,0 +1,55 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Status - результат последних вызовов API Connect
+	Status struct {
+		LastSuccess *time.Time `json:"last_success,omitempty"`
+		LastError   *time.Time `json:"last_error,omitempty"`
+		Error       string     `json:"error,omitempty"`
+	}
+)
+
+var (
+	statusMu sync.Mutex
+	status   Status
+)
+
+// report запоминает результат вызова. Ответ 4xx, кроме 401 и 403, значит, что Connect
+// доступен и авторизация прошла - для готовности это успешный вызов
+func report(err error) {
+	if httpErr, ok := err.(*HttpError); ok && httpErr.Code >= 400 && httpErr.Code < 500 &&
+		httpErr.Code != 401 && httpErr.Code != 403 {
+		err = nil
+	}
+
+	now := time.Now()
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	if err == nil {
+		status.LastSuccess = &now
+		return
+	}
+
+	status.LastError = &now
+	status.Error = err.Error()
+}
+
+// GetStatus возвращает время последнего успешного и неуспешного вызова API
+func GetStatus() Status {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	return status
+}
+
+// Healthy - последний вызов API прошел успешно или вызовов еще не было
+func (s Status) Healthy() bool {
+	return s.LastError == nil || (s.LastSuccess != nil && s.LastSuccess.After(*s.LastError))
+}
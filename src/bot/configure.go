@@ -0,0 +1,35 @@
+package bot
+
+import (
+	"fmt"
+
+	"connect-companion/bot/flood"
+	"connect-companion/bot/routing"
+	"connect-companion/bot/schedule"
+	"connect-companion/config"
+)
+
+// Configure проверяет и применяет настройки диалогов: рабочее время, маршрутизацию,
+// ограничения частоты, каталог документов, тексты и эксперименты. Middleware настраиваются отдельно
+func Configure(cnf *config.Conf) error {
+	if err := schedule.Configure(cnf); err != nil {
+		return fmt.Errorf("business hours: %w", err)
+	}
+	if err := routing.Configure(cnf); err != nil {
+		return fmt.Errorf("routing: %w", err)
+	}
+	if err := flood.Configure(cnf); err != nil {
+		return fmt.Errorf("flood: %w", err)
+	}
+	if err := ConfigureDocuments(cnf); err != nil {
+		return fmt.Errorf("documents: %w", err)
+	}
+	if err := ConfigureTemplates(cnf); err != nil {
+		return fmt.Errorf("texts: %w", err)
+	}
+	if err := ConfigureExperiments(cnf); err != nil {
+		return fmt.Errorf("experiments: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"strings"
+	"time"
+
+	"connect-companion/bot/audit"
+	"connect-companion/bot/client"
+	"connect-companion/bot/events"
+	"connect-companion/bot/experiments"
+	"connect-companion/bot/messages"
+	"connect-companion/bot/survey"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	// Обращение закрыл сам Connect, например по таймауту
+	ACTOR_CONNECT = "connect"
+	// Обращение закрыл специалист, в журнале - с его Id: spec:<uuid>
+	ACTOR_SPEC = "spec"
+)
+
+// closeTreatment закрывает обращение и, если включено, предлагает его оценить
+func closeTreatment(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	cnf := c.MustGet("cnf").(*config.Conf)
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	countOutcome(c, chatState, experiments.METRIC_CLOSED)
+
+	// Отмечаем опрос до закрытия, чтобы push о закрытии не начал его второй раз
+	withSurvey := cnf.Survey.Enabled && survey.MarkStarted(db, msg.LineId, msg.UserId)
+
+	next, err := msg.CloseTreatment(c, BOT_PHRASE_BYE, database.STATE_GREETINGS)
+	if err != nil || !withSurvey {
+		return next, err
+	}
+
+	return beginSurvey(c, msg, chatState, chatState.Topic, nil)
+}
+
+// treatmentClosed обрабатывает push о закрытии обращения специалистом
+func treatmentClosed(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	cnf := c.MustGet("cnf").(*config.Conf)
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	by := closedBy(cnf, msg)
+	// О закрытии ботом событие уже отправил messages.CloseTreatment
+	if by != client.ACTOR_BOT {
+		data := map[string]interface{}{"by": by}
+		if by == ACTOR_SPEC {
+			data["spec_id"] = msg.MessageAuthor
+		}
+		events.Emit(events.New(events.CLOSED, msg.LineId, msg.UserId, data))
+	}
+	auditClosed(db, msg, by)
+
+	// Тема нужна опросу для статистики по темам, а следующему обращению - уже нет
+	topic := chatState.Topic
+	chatState.Topic = ""
+
+	if !cnf.Survey.Enabled {
+		return msg.Start(database.STATE_GREETINGS)
+	}
+	if !survey.MarkStarted(db, msg.LineId, msg.UserId) {
+		return chatState.CurrentState, nil
+	}
+
+	var specId *uuid.UUID
+	if msg.MessageAuthor != nil && (cnf.SpecID == nil || *msg.MessageAuthor != *cnf.SpecID) {
+		specId = msg.MessageAuthor
+	}
+
+	return beginSurvey(c, msg, chatState, topic, specId)
+}
+
+// closedBy определяет, кто закрыл обращение: без автора его закрыл Connect (по таймауту),
+// с автором бота - сам бот, иначе - специалист
+func closedBy(cnf *config.Conf, msg *messages.Message) string {
+	switch {
+	case msg.MessageAuthor == nil:
+		return ACTOR_CONNECT
+	case cnf.SpecID != nil && *msg.MessageAuthor == *cnf.SpecID:
+		return client.ACTOR_BOT
+	}
+
+	return ACTOR_SPEC
+}
+
+// auditClosed записывает, кто закрыл обращение
+func auditClosed(db redis.UniversalClient, msg *messages.Message, by string) {
+	actor := by
+	if by == ACTOR_SPEC {
+		actor = ACTOR_SPEC + ":" + msg.MessageAuthor.String()
+	}
+
+	err := audit.Record(db, audit.Entry{
+		Actor:     actor,
+		Action:    audit.ACTION_TREATMENT_CLOSED,
+		UserId:    &msg.UserId,
+		LineId:    &msg.LineId,
+		MessageId: &msg.MessageID,
+		Result:    audit.RESULT_OK,
+	})
+	if err != nil {
+		logger.Warning("Error while record audit", err)
+	}
+}
+
+func beginSurvey(c *gin.Context, msg *messages.Message, chatState *database.Chat, topic string, specId *uuid.UUID) (database.ChatState, error) {
+	chatState.Survey = &database.SurveyProgress{
+		SpecId:   specId,
+		Topic:    topic,
+		ClosedAt: time.Now(),
+	}
+
+	return enter(c, msg, chatState, database.STATE_SURVEY)
+}
+
+func rate(rating int) Action {
+	return func(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+		cnf := c.MustGet("cnf").(*config.Conf)
+
+		if chatState.Survey == nil {
+			return toMainMenu(c, msg, chatState)
+		}
+		chatState.Survey.Rating = rating
+
+		if cnf.Survey.Comment {
+			return enter(c, msg, chatState, database.STATE_SURVEY_COMMENT)
+		}
+
+		return finishSurvey(c, msg, chatState, "")
+	}
+}
+
+func skipSurveyComment(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	return finishSurvey(c, msg, chatState, "")
+}
+
+func surveyComment(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	return finishSurvey(c, msg, chatState, strings.TrimSpace(msg.Text))
+}
+
+// abandonSurvey - пользователь вместо оценки начал новый разговор
+func abandonSurvey(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	chatState.Survey = nil
+
+	return toMainMenu(c, msg, chatState)
+}
+
+func finishSurvey(c *gin.Context, msg *messages.Message, chatState *database.Chat, comment string) (database.ChatState, error) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	progress := chatState.Survey
+	chatState.Survey = nil
+
+	if progress == nil {
+		return toMainMenu(c, msg, chatState)
+	}
+
+	err := survey.Save(db, database.SurveyResult{
+		LineId:     msg.LineId,
+		UserId:     msg.UserId,
+		SpecId:     progress.SpecId,
+		Topic:      progress.Topic,
+		Rating:     progress.Rating,
+		Comment:    comment,
+		ClosedAt:   progress.ClosedAt,
+		AnsweredAt: time.Now(),
+	})
+	if err != nil {
+		logger.Warning("Error while save survey result", err)
+	}
+
+	return msg.Send(c, BOT_PHRASE_SURVEY_THANKS, database.STATE_GREETINGS, nil)
+}
@@ -0,0 +1,263 @@
+package bot
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"connect-companion/database"
+)
+
+const (
+	DIAGRAM_DOT     = "dot"
+	DIAGRAM_MERMAID = "mermaid"
+
+	NODE_STATE  = "state"
+	NODE_ACTION = "action"
+	NODE_START  = "start"
+	NODE_CODE   = "code"
+
+	// Состояние, в котором обращение начинается и заканчивается. Не описано в states:
+	// ввод в нем handleText, как и в любом неописанном состоянии, ведет в главное меню
+	STATE_NAME_GREETINGS = "greetings"
+
+	// Узел для переходов, которые решает код: Do, OnText, OnFile и встроенные действия
+	NODE_NAME_CODE = "code"
+
+	// Сколько подписей пунктов показывать на одной стрелке, остальные сворачиваются в "еще N"
+	DIAGRAM_MAX_LABELS = 4
+)
+
+type (
+	// Diagram - состояния и переходы диалога, собранные из того же описания, по которому работает бот
+	Diagram struct {
+		Nodes []DiagramNode `json:"nodes"`
+		Edges []DiagramEdge `json:"edges"`
+	}
+
+	DiagramNode struct {
+		Id    string `json:"id"`
+		Label string `json:"label"`
+		Kind  string `json:"kind"`
+	}
+
+	// DiagramEdge - переход. Labels - ввод, который к нему приводит
+	DiagramEdge struct {
+		From   string   `json:"from"`
+		To     string   `json:"to"`
+		Labels []string `json:"labels"`
+	}
+)
+
+var (
+	actionLabels = map[string]string{
+		ACTION_CLOSE:   "Закрыть обращение",
+		ACTION_REROUTE: "Перевод на специалиста",
+	}
+)
+
+// FlowDiagram собирает схему диалога только из того, что исполняет handleText: Goto, File,
+// Form и Action пунктов меню. Куда переведут Do, OnText, OnFile и действия, решает код,
+// поэтому они ведут в узел "обработчик на Go", а из него - в состояния с EnteredByCode.
+// Кнопки "Назад" и "В главное меню" есть во всех некорневых состояниях и не показываются
+func FlowDiagram() *Diagram {
+	d := &Diagram{}
+	nodes := map[string]bool{}
+	edges := map[[2]string]int{}
+
+	node := func(id string) {
+		if nodes[id] {
+			return
+		}
+		nodes[id] = true
+
+		kind, label := NODE_STATE, id
+		switch {
+		case id == STATE_NAME_GREETINGS:
+			kind = NODE_START
+		case id == NODE_NAME_CODE:
+			kind, label = NODE_CODE, "обработчик на Go"
+		case actions[id] != nil && !isStateName(id):
+			kind = NODE_ACTION
+			if text, ok := actionLabels[id]; ok {
+				label = text
+			}
+		}
+
+		d.Nodes = append(d.Nodes, DiagramNode{Id: id, Label: label, Kind: kind})
+	}
+
+	edge := func(from string, to string, label string) {
+		node(from)
+		node(to)
+
+		key := [2]string{from, to}
+		i, ok := edges[key]
+		if !ok {
+			i = len(d.Edges)
+			edges[key] = i
+			d.Edges = append(d.Edges, DiagramEdge{From: from, To: to})
+		}
+		if label != "" {
+			d.Edges[i].Labels = append(d.Edges[i].Labels, label)
+		}
+	}
+
+	edge(STATE_NAME_GREETINGS, StateName(database.STATE_MAIN_MENU), "любое сообщение")
+
+	for _, id := range stateIds() {
+		state := states[id]
+		node(state.Name)
+
+		for _, option := range state.options() {
+			for _, to := range option.targets() {
+				edge(state.Name, to, option.Text)
+			}
+		}
+
+		var inputs []string
+		if state.OnText != nil {
+			inputs = append(inputs, "текст")
+		}
+		if state.OnFile != nil {
+			inputs = append(inputs, "файл")
+		}
+		if len(inputs) > 0 {
+			edge(state.Name, NODE_NAME_CODE, strings.Join(inputs, ", "))
+		}
+	}
+
+	for _, id := range stateIds() {
+		if state := states[id]; state.EnteredByCode {
+			edge(NODE_NAME_CODE, state.Name, "")
+		}
+	}
+
+	return d
+}
+
+// targets - узлы, в которые ведет пункт меню
+func (option *Option) targets() []string {
+	switch {
+	case option.Do != nil:
+		return []string{NODE_NAME_CODE}
+	case option.File != "":
+		return []string{StateName(database.STATE_PARTING)}
+	case option.Form != "":
+		return []string{StateName(database.STATE_FORM)}
+	case option.Action == ACTION_MAIN_MENU:
+		return []string{StateName(database.STATE_MAIN_MENU)}
+	case option.Action == ACTION_BACK:
+		return nil
+	case option.Action != "":
+		return []string{option.Action}
+	}
+
+	return []string{StateName(option.Goto)}
+}
+
+// label сворачивает длинный список подписей, чтобы каталог не превращал стрелку в простыню
+func (edge *DiagramEdge) label() []string {
+	if len(edge.Labels) <= DIAGRAM_MAX_LABELS {
+		return edge.Labels
+	}
+
+	labels := append([]string{}, edge.Labels[:DIAGRAM_MAX_LABELS-1]...)
+
+	return append(labels, fmt.Sprintf("еще %d", len(edge.Labels)-DIAGRAM_MAX_LABELS+1))
+}
+
+// WriteDiagram выводит схему в формате DIAGRAM_DOT или DIAGRAM_MERMAID
+func WriteDiagram(w io.Writer, format string) error {
+	switch format {
+	case DIAGRAM_DOT:
+		return FlowDiagram().WriteDOT(w)
+	case DIAGRAM_MERMAID:
+		return FlowDiagram().WriteMermaid(w)
+	}
+
+	return fmt.Errorf("unknown diagram format %q", format)
+}
+
+// WriteDOT выводит схему для Graphviz
+func (d *Diagram) WriteDOT(w io.Writer) error {
+	shapes := map[string]string{
+		NODE_STATE:  "box, style=rounded",
+		NODE_ACTION: "box, style=\"rounded,filled\", fillcolor=lightgrey",
+		NODE_START:  "circle",
+		NODE_CODE:   "note",
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph flow {\n\trankdir=LR;\n\tnode [fontname=\"Helvetica\"];\n\tedge [fontname=\"Helvetica\", fontsize=10];\n\n")
+
+	for _, node := range d.Nodes {
+		fmt.Fprintf(&b, "\t%s [label=%s, shape=%s];\n", dotQuote(node.Id), dotQuote(node.Label), shapes[node.Kind])
+	}
+	b.WriteString("\n")
+
+	for i := range d.Edges {
+		edge := &d.Edges[i]
+		fmt.Fprintf(&b, "\t%s -> %s", dotQuote(edge.From), dotQuote(edge.To))
+		if labels := edge.label(); len(labels) > 0 {
+			fmt.Fprintf(&b, " [label=%s]", dotQuote(strings.Join(labels, "\n")))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// WriteMermaid выводит схему для Mermaid (её понимают GitLab, GitHub и Confluence)
+func (d *Diagram) WriteMermaid(w io.Writer) error {
+	shapes := map[string]string{
+		NODE_STATE:  "[%s]",
+		NODE_ACTION: "([%s])",
+		NODE_START:  "((%s))",
+		NODE_CODE:   "[/%s/]",
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+
+	for _, node := range d.Nodes {
+		fmt.Fprintf(&b, "    %s"+shapes[node.Kind]+"\n", mermaidId(node.Id), mermaidQuote(node.Label))
+	}
+
+	for i := range d.Edges {
+		edge := &d.Edges[i]
+		fmt.Fprintf(&b, "    %s -->", mermaidId(edge.From))
+		if labels := edge.label(); len(labels) > 0 {
+			fmt.Fprintf(&b, "|%s|", mermaidQuote(strings.Join(labels, "<br/>")))
+		}
+		fmt.Fprintf(&b, " %s\n", mermaidId(edge.To))
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func isStateName(name string) bool {
+	_, ok := stateByName(name)
+
+	return ok
+}
+
+func dotQuote(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(text)
+
+	return `"` + text + `"`
+}
+
+// mermaidId - идентификатор узла. Префикс не дает совпасть с ключевыми словами вроде end
+func mermaidId(id string) string {
+	return "n_" + strings.NewReplacer("-", "_", ".", "_", " ", "_").Replace(id)
+}
+
+func mermaidQuote(text string) string {
+	return `"` + strings.Replace(text, `"`, "#quot;", -1) + `"`
+}
@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+)
+
+const (
+	TOPIC_DOCUMENT = "document"
+)
+
+var (
+	// Какие файлы из files_dir попадают в каталог при documents.scan
+	documentExtensions = map[string]bool{
+		".pdf": true, ".doc": true, ".docx": true, ".odt": true, ".rtf": true,
+		".xls": true, ".xlsx": true, ".ods": true, ".txt": true,
+	}
+)
+
+// ConfigureDocuments собирает каталог документов из конфигурации и, если включено,
+// из файлов в files_dir. Без настроек остается каталог по умолчанию
+func ConfigureDocuments(cnf *config.Conf) error {
+	state := states[database.STATE_DOCUMENTS]
+
+	if cnf.Documents.Columns > 0 {
+		state.Columns = cnf.Documents.Columns
+	}
+	if cnf.Documents.PageSize > 0 {
+		state.PageSize = cnf.Documents.PageSize
+	}
+
+	if len(cnf.Documents.Items) == 0 && !cnf.Documents.Scan {
+		return nil
+	}
+
+	listed := map[string]bool{}
+	var catalog []Option
+
+	for _, item := range cnf.Documents.Items {
+		listed[item.File] = true
+		catalog = append(catalog, documentOption(item))
+	}
+
+	if cnf.Documents.Scan {
+		files, err := ioutil.ReadDir(cnf.FilesDir)
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Name() < files[j].Name()
+		})
+
+		for _, file := range files {
+			name := file.Name()
+			ext := strings.ToLower(filepath.Ext(name))
+			if file.IsDir() || strings.HasPrefix(name, ".") || !documentExtensions[ext] || listed[name] {
+				continue
+			}
+
+			catalog = append(catalog, documentOption(config.Document{File: name}))
+		}
+	}
+
+	for _, option := range catalog {
+		if _, err := os.Stat(filepath.Join(cnf.FilesDir, option.File)); err != nil {
+			logger.Warning("Document", option.File, "is not available:", err)
+		}
+	}
+
+	state.Catalog = catalog
+
+	return nil
+}
+
+// documentOption - пункт каталога. Id считается по имени файла, а не по заголовку,
+// чтобы переименование пункта не ломало уже отправленные клавиатуры
+func documentOption(doc config.Document) Option {
+	title := doc.Title
+	if title == "" {
+		title = strings.TrimSuffix(doc.File, filepath.Ext(doc.File))
+	}
+
+	topic := doc.Topic
+	if topic == "" {
+		topic = TOPIC_DOCUMENT
+	}
+
+	return Option{
+		Id:    stableId(doc.File),
+		Text:  title,
+		Topic: topic,
+		File:  doc.File,
+	}
+}
@@ -0,0 +1,72 @@
+package bot
+
+import (
+	"sync"
+	"time"
+
+	"connect-companion/logger"
+)
+
+const (
+	DEFAULT_DRAIN_TIMEOUT = 20 * time.Second
+)
+
+var (
+	drainMu  sync.RWMutex
+	draining bool
+	inflight sync.WaitGroup
+)
+
+// track учитывает начатую обработку, по ее окончании нужно вызвать untrack.
+// Возвращает false, если бот уже останавливается
+func track() bool {
+	drainMu.RLock()
+	defer drainMu.RUnlock()
+
+	if draining {
+		return false
+	}
+
+	inflight.Add(1)
+
+	return true
+}
+
+func untrack() {
+	inflight.Done()
+}
+
+// Draining сообщает, что бот останавливается и новые сообщения не принимает
+func Draining() bool {
+	drainMu.RLock()
+	defer drainMu.RUnlock()
+
+	return draining
+}
+
+// Drain перестает принимать новые сообщения и ждет завершения начатых не дольше timeout.
+// Возвращает false, если дождаться не удалось
+func Drain(timeout time.Duration) bool {
+	if timeout <= 0 {
+		timeout = DEFAULT_DRAIN_TIMEOUT
+	}
+
+	drainMu.Lock()
+	draining = true
+	drainMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+
+	logger.Info("Waiting for conversations in progress, up to", timeout)
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
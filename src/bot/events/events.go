@@ -0,0 +1,366 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	STATE_CHANGED = "state_changed"
+	FILE_SENT     = "file_sent"
+	REROUTED      = "rerouted"
+	CLOSED        = "closed"
+
+	QUEUE_SIZE = 1000
+	WORKERS    = 2
+
+	DEFAULT_MAX_ATTEMPTS = 5
+	DEFAULT_TIMEOUT      = 10 * time.Second
+	FIRST_RETRY_DELAY    = time.Second
+)
+
+type (
+	// Event - уведомление внешней системы о действии бота
+	Event struct {
+		Id     uuid.UUID              `json:"id" format:"uuid"`
+		Type   string                 `json:"type" example:"rerouted"`
+		Time   time.Time              `json:"time"`
+		LineId uuid.UUID              `json:"line_id" format:"uuid"`
+		UserId uuid.UUID              `json:"user_id" format:"uuid"`
+		Data   map[string]interface{} `json:"data,omitempty"`
+	}
+
+	// DeadLetter - событие, которое не удалось доставить за все попытки
+	DeadLetter struct {
+		Url      string    `json:"url"`
+		Event    Event     `json:"event"`
+		Error    string    `json:"error"`
+		Attempts int       `json:"attempts"`
+		FailedAt time.Time `json:"failed_at"`
+	}
+
+	delivery struct {
+		hook  *config.Webhook
+		event Event
+	}
+)
+
+var (
+	hooks []config.Webhook
+	db    redis.UniversalClient
+	queue = make(chan delivery, QUEUE_SIZE)
+
+	client = &http.Client{}
+)
+
+// Start запускает доставку событий на адреса из конфигурации
+func Start(ctx context.Context, cnf *config.Conf, redisClient redis.UniversalClient) {
+	hooks = cnf.Webhooks
+	db = redisClient
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	logger.Info("Start webhook delivery to", len(hooks), "endpoints")
+
+	for i := 0; i < WORKERS; i++ {
+		go work(ctx)
+	}
+}
+
+func New(eventType string, lineId uuid.UUID, userId uuid.UUID, data map[string]interface{}) Event {
+	return Event{
+		Id:     uuid.New(),
+		Type:   eventType,
+		Time:   time.Now(),
+		LineId: lineId,
+		UserId: userId,
+		Data:   data,
+	}
+}
+
+// Emit ставит событие в очередь для всех подписанных адресов. Не блокирует:
+// при переполнении очереди событие сразу попадает в список недоставленных
+func Emit(event Event) {
+	for i := range hooks {
+		if !subscribed(&hooks[i], event.Type) {
+			continue
+		}
+
+		select {
+		case queue <- delivery{hook: &hooks[i], event: event}:
+		default:
+			bury(hooks[i].Url, event, "queue overflow", 0)
+		}
+	}
+}
+
+func subscribed(hook *config.Webhook, eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+
+	for _, e := range hook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case d := <-queue:
+			deliver(ctx, d)
+		}
+	}
+}
+
+// flush сохраняет оставшиеся в очереди события в недоставленные, чтобы не потерять их при остановке
+func flush() {
+	for {
+		select {
+		case d := <-queue:
+			bury(d.hook.Url, d.event, "shutdown", 0)
+		default:
+			return
+		}
+	}
+}
+
+// deliver отправляет событие с повторами через 1, 2, 4... секунды
+func deliver(ctx context.Context, d delivery) {
+	maxAttempts := d.hook.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+
+	body, err := json.Marshal(d.event)
+	if err != nil {
+		bury(d.hook.Url, d.event, err.Error(), 0)
+		return
+	}
+
+	delay := FIRST_RETRY_DELAY
+	for attempt := 1; ; attempt++ {
+		err = post(d.hook, d.event, body)
+		if err == nil {
+			logger.Debug("Webhook", d.event.Type, "delivered to", d.hook.Url)
+			return
+		}
+
+		logger.Warning("Webhook", d.event.Type, "to", d.hook.Url, "attempt", attempt, "failed:", err)
+
+		if attempt >= maxAttempts {
+			bury(d.hook.Url, d.event, err.Error(), attempt)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			bury(d.hook.Url, d.event, "shutdown: "+err.Error(), attempt)
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func post(hook *config.Webhook, event Event, body []byte) error {
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bot-Event", event.Type)
+	req.Header.Set("X-Bot-Delivery", event.Id.String())
+	if hook.Secret != "" {
+		req.Header.Set("X-Bot-Signature", "sha256="+Sign(hook.Secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign возвращает HMAC-SHA256 тела в hex - так же подпись проверяет получатель
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func deadLettersKey() string {
+	return database.PREFIX_WEBHOOK + "dead"
+}
+
+func bury(url string, event Event, reason string, attempts int) {
+	logger.Warning("Webhook", event.Type, "to", url, "moved to dead letters:", reason)
+
+	if db == nil {
+		return
+	}
+
+	data, err := json.Marshal(DeadLetter{
+		Url:      url,
+		Event:    event,
+		Error:    reason,
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	if err = db.RPush(deadLettersKey(), data).Err(); err != nil {
+		logger.Warning("Error while save dead letter", err)
+	}
+}
+
+// DeadLetters возвращает недоставленные события
+func DeadLetters() ([]DeadLetter, error) {
+	items, err := db.LRange(deadLettersKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(items))
+	for _, item := range items {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(item), &letter); err != nil {
+			logger.Warning("Error while decoding dead letter", err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, nil
+}
+
+// RetryDeadLetters снова ставит в очередь недоставленные события на адреса,
+// которые остались в конфигурации. Перебирает список, каким он был на момент вызова:
+// события, которые снова не доставятся, попадут в конец и ждут следующего повтора.
+// Нечитаемые события и события на удаленные адреса остаются в списке. Возвращает число событий в очереди
+func RetryDeadLetters() (int, error) {
+	retried := 0
+
+	items, err := db.LRange(deadLettersKey(), 0, -1).Result()
+	if err != nil {
+		return retried, err
+	}
+
+	for _, item := range items {
+		var letter DeadLetter
+		if err = json.Unmarshal([]byte(item), &letter); err != nil {
+			logger.Warning("Error while decoding dead letter", err)
+			continue
+		}
+
+		hook := hookByUrl(letter.Url)
+		if hook == nil {
+			continue
+		}
+
+		select {
+		case queue <- delivery{hook: hook, event: letter.Event}:
+		default:
+			return retried, nil
+		}
+		retried++
+
+		if err = db.LRem(deadLettersKey(), 1, item).Err(); err != nil {
+			return retried, err
+		}
+	}
+
+	return retried, nil
+}
+
+func hookByUrl(url string) *config.Webhook {
+	for i := range hooks {
+		if hooks[i].Url == url {
+			return &hooks[i]
+		}
+	}
+
+	return nil
+}
+
+// DeadLettersOf возвращает недоставленные события о пользователе
+func DeadLettersOf(db redis.UniversalClient, userId uuid.UUID) ([]DeadLetter, error) {
+	return userDeadLetters(db, userId, false)
+}
+
+// ForgetDeadLetters удаляет недоставленные события о пользователе. Возвращает их число
+func ForgetDeadLetters(db redis.UniversalClient, userId uuid.UUID) (int, error) {
+	letters, err := userDeadLetters(db, userId, true)
+
+	return len(letters), err
+}
+
+func userDeadLetters(db redis.UniversalClient, userId uuid.UUID, remove bool) ([]DeadLetter, error) {
+	items, err := db.LRange(deadLettersKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var letters []DeadLetter
+	for _, item := range items {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(item), &letter); err != nil || letter.Event.UserId != userId {
+			continue
+		}
+
+		if remove {
+			if err = db.LRem(deadLettersKey(), 0, item).Err(); err != nil {
+				return letters, err
+			}
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, nil
+}
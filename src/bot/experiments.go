@@ -0,0 +1,161 @@
+package bot
+
+import (
+	"fmt"
+
+	"connect-companion/bot/experiments"
+	"connect-companion/bot/messages"
+	"connect-companion/config"
+	"connect-companion/database"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+)
+
+// ConfigureExperiments проверяет эксперименты: тексты вариантов должны компилироваться,
+// а состояния и пункты меню, на которые они ссылаются, - существовать
+func ConfigureExperiments(cnf *config.Conf) error {
+	if err := experiments.Configure(cnf); err != nil {
+		return err
+	}
+
+	for _, experiment := range cnf.Experiments {
+		for _, variant := range experiment.Variants {
+			where := experiment.Name + "/" + variant.Name
+
+			for name, text := range variant.Prompts {
+				if _, ok := stateByName(name); !ok {
+					return fmt.Errorf("%s: prompt for unknown state %q", where, name)
+				}
+				if err := compileTemplate(text); err != nil {
+					return fmt.Errorf("%s: prompt of %s: %w", where, name, err)
+				}
+			}
+
+			for name, order := range variant.Menus {
+				state, ok := stateByName(name)
+				if !ok {
+					return fmt.Errorf("%s: menu of unknown state %q", where, name)
+				}
+				for _, id := range order {
+					if menuRow(state.Menu, id) < 0 {
+						return fmt.Errorf("%s: no option %q in menu of %s", where, id, name)
+					}
+				}
+			}
+
+			for from, to := range variant.States {
+				if _, ok := stateByName(from); !ok {
+					return fmt.Errorf("%s: unknown state %q", where, from)
+				}
+				if _, ok := stateByName(to); !ok {
+					return fmt.Errorf("%s: unknown state %q", where, to)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// assignExperiments распределяет чат по вариантам экспериментов, в которых он еще не участвует.
+// Возвращает новые назначения: их учитывают в METRIC_CHATS только после сохранения состояния,
+// чтобы сообщения, отброшенные middleware, не считались новыми чатами
+func assignExperiments(msg *messages.Message, chatState *database.Chat) map[string]string {
+	if chatState.Experiments == nil {
+		chatState.Experiments = map[string]string{}
+	}
+
+	return experiments.Assign(chatState.Experiments, msg.UserId)
+}
+
+// countOutcome учитывает исход диалога в вариантах чата
+func countOutcome(c *gin.Context, chatState *database.Chat, metric string) {
+	countVariants(c, chatState.Experiments, metric)
+}
+
+func countVariants(c *gin.Context, assigned map[string]string, metric string) {
+	if len(assigned) == 0 {
+		return
+	}
+
+	db := c.MustGet("db").(redis.UniversalClient)
+	experiments.Count(db, assigned, metric)
+}
+
+// variant возвращает состояние таким, каким его видит чат: с текстом и порядком меню
+// из его вариантов. Пункты меню не меняются, поэтому ввод разбирается по исходному состоянию
+func (state *State) variant(chatState *database.Chat) *State {
+	view := state
+
+	for _, variant := range experiments.Active(chatState.Experiments) {
+		prompt, hasPrompt := variant.Prompts[state.Name]
+		order, hasOrder := variant.Menus[state.Name]
+		if !hasPrompt && !hasOrder {
+			continue
+		}
+
+		copied := *view
+		view = &copied
+
+		if hasPrompt {
+			view.Prompt = prompt
+			view.PromptFunc = nil
+		}
+		if hasOrder {
+			view.Menu = reorderMenu(view.Menu, order)
+		}
+	}
+
+	return view
+}
+
+// substitute возвращает состояние, которое вариант чата показывает вместо to
+func substitute(chatState *database.Chat, to database.ChatState) database.ChatState {
+	for _, variant := range experiments.Active(chatState.Experiments) {
+		if name, ok := variant.States[StateName(to)]; ok {
+			if id, ok := StateId(name); ok {
+				to = id
+			}
+		}
+	}
+
+	return to
+}
+
+// reorderMenu ставит ряды с пунктами из order в начало в указанном порядке, остальные - после
+func reorderMenu(menu [][]Option, order []string) [][]Option {
+	used := make([]bool, len(menu))
+	reordered := make([][]Option, 0, len(menu))
+
+	for _, id := range order {
+		if i := menuRow(menu, id); i >= 0 && !used[i] {
+			used[i] = true
+			reordered = append(reordered, menu[i])
+		}
+	}
+	for i, row := range menu {
+		if !used[i] {
+			reordered = append(reordered, row)
+		}
+	}
+
+	return reordered
+}
+
+func menuRow(menu [][]Option, id string) int {
+	for i, row := range menu {
+		for _, option := range row {
+			if option.Id == id {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// Variant возвращает вариант эксперимента, в который попал чат, или пустую строку
+func (ctx *Context) Variant(experiment string) string {
+	return ctx.Chat.Experiments[experiment]
+}
@@ -0,0 +1,221 @@
+package experiments
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	// Чаты, попавшие в вариант
+	METRIC_CHATS = "chats"
+	// Обращения, закрытые ботом
+	METRIC_CLOSED = "closed"
+	// Переводы на специалиста
+	METRIC_REROUTED = "rerouted"
+	// Ввод, который бот не понял
+	METRIC_FALLBACKS = "fallbacks"
+)
+
+type (
+	// Stats - исходы диалогов в варианте эксперимента
+	Stats struct {
+		Experiment string `json:"experiment" example:"short_greeting"`
+		Variant    string `json:"variant" example:"short"`
+		Chats      int64  `json:"chats" example:"120"`
+		Closed     int64  `json:"closed" example:"70"`
+		Rerouted   int64  `json:"rerouted" example:"35"`
+		Fallbacks  int64  `json:"fallbacks" example:"48"`
+		// Доли от числа чатов, в процентах, и непонятый ввод на чат
+		CloseRate        float64 `json:"close_rate" example:"58.3"`
+		RerouteRate      float64 `json:"reroute_rate" example:"29.2"`
+		FallbacksPerChat float64 `json:"fallbacks_per_chat" example:"0.4"`
+	}
+)
+
+var (
+	metrics = []string{METRIC_CHATS, METRIC_CLOSED, METRIC_REROUTED, METRIC_FALLBACKS}
+
+	list []config.Experiment
+)
+
+func key(experiment string) string {
+	return database.PREFIX_EXPERIMENT + experiment
+}
+
+// Configure проверяет описание экспериментов. Тексты и состояния вариантов проверяет бот
+func Configure(cnf *config.Conf) error {
+	names := map[string]bool{}
+
+	for _, experiment := range cnf.Experiments {
+		if experiment.Name == "" {
+			return fmt.Errorf("experiment without name")
+		}
+		if names[experiment.Name] {
+			return fmt.Errorf("duplicate experiment %q", experiment.Name)
+		}
+		names[experiment.Name] = true
+
+		if len(experiment.Variants) == 0 {
+			return fmt.Errorf("experiment %q: no variants", experiment.Name)
+		}
+
+		variants := map[string]bool{}
+		total := 0
+		for _, variant := range experiment.Variants {
+			if variant.Name == "" || strings.Contains(variant.Name, ":") {
+				return fmt.Errorf("experiment %q: bad variant name %q", experiment.Name, variant.Name)
+			}
+			if variants[variant.Name] {
+				return fmt.Errorf("experiment %q: duplicate variant %q", experiment.Name, variant.Name)
+			}
+			variants[variant.Name] = true
+
+			if variant.Weight < 0 {
+				return fmt.Errorf("experiment %q: negative weight of variant %q", experiment.Name, variant.Name)
+			}
+			total += weight(variant)
+		}
+		if total == 0 {
+			return fmt.Errorf("experiment %q: all variants have zero weight", experiment.Name)
+		}
+	}
+
+	list = cnf.Experiments
+
+	return nil
+}
+
+func weight(variant config.Variant) int {
+	if variant.Weight == 0 {
+		return 1
+	}
+
+	return variant.Weight
+}
+
+// Bucket выбирает вариант по UserId. Один и тот же пользователь всегда попадает
+// в один вариант, пока не изменится список вариантов или их веса
+func Bucket(experiment config.Experiment, userId uuid.UUID) string {
+	sum := sha1.Sum([]byte(experiment.Name + ":" + userId.String()))
+	n := binary.BigEndian.Uint32(sum[:4])
+
+	total := 0
+	for _, variant := range experiment.Variants {
+		total += weight(variant)
+	}
+
+	point := int(n % uint32(total))
+	for _, variant := range experiment.Variants {
+		if point < weight(variant) {
+			return variant.Name
+		}
+		point -= weight(variant)
+	}
+
+	return experiment.Variants[len(experiment.Variants)-1].Name
+}
+
+// Assign дописывает в assigned варианты экспериментов, в которых чат еще не участвует.
+// Уже назначенный вариант не меняется, даже если веса поменяли. Возвращает новые назначения
+func Assign(assigned map[string]string, userId uuid.UUID) map[string]string {
+	added := map[string]string{}
+
+	for _, experiment := range list {
+		if _, ok := assigned[experiment.Name]; ok {
+			continue
+		}
+
+		variant := Bucket(experiment, userId)
+		assigned[experiment.Name] = variant
+		added[experiment.Name] = variant
+	}
+
+	return added
+}
+
+// Active возвращает варианты из assigned для идущих экспериментов в порядке конфигурации
+func Active(assigned map[string]string) []config.Variant {
+	var variants []config.Variant
+
+	for _, experiment := range list {
+		name, ok := assigned[experiment.Name]
+		if !ok {
+			continue
+		}
+		for _, variant := range experiment.Variants {
+			if variant.Name == name {
+				variants = append(variants, variant)
+			}
+		}
+	}
+
+	return variants
+}
+
+// Count увеличивает счетчик metric во всех вариантах чата. Эксперименты,
+// которых уже нет в конфигурации, не учитываются
+func Count(db redis.UniversalClient, assigned map[string]string, metric string) {
+	for _, experiment := range list {
+		variant, ok := assigned[experiment.Name]
+		if !ok {
+			continue
+		}
+
+		if err := db.HIncrBy(key(experiment.Name), variant+":"+metric, 1).Err(); err != nil {
+			logger.Warning("Error while count experiment", experiment.Name, metric, err)
+		}
+	}
+}
+
+// Report возвращает исходы по всем вариантам идущих экспериментов
+func Report(db redis.UniversalClient) ([]Stats, error) {
+	var report []Stats
+
+	for _, experiment := range list {
+		counters, err := db.HGetAll(key(experiment.Name)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, variant := range experiment.Variants {
+			values := map[string]int64{}
+			for _, metric := range metrics {
+				values[metric], _ = strconv.ParseInt(counters[variant.Name+":"+metric], 10, 64)
+			}
+
+			stats := Stats{
+				Experiment: experiment.Name,
+				Variant:    variant.Name,
+				Chats:      values[METRIC_CHATS],
+				Closed:     values[METRIC_CLOSED],
+				Rerouted:   values[METRIC_REROUTED],
+				Fallbacks:  values[METRIC_FALLBACKS],
+			}
+			if stats.Chats > 0 {
+				chats := float64(stats.Chats)
+				stats.CloseRate = float64(stats.Closed) * 100 / chats
+				stats.RerouteRate = float64(stats.Rerouted) * 100 / chats
+				stats.FallbacksPerChat = float64(stats.Fallbacks) / chats
+			}
+
+			report = append(report, stats)
+		}
+	}
+
+	return report, nil
+}
+
+// Reset обнуляет счетчики эксперимента, например после исправления варианта
+func Reset(db redis.UniversalClient, experiment string) error {
+	return db.Del(key(experiment)).Err()
+}
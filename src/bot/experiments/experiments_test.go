@@ -0,0 +1,76 @@
+package experiments
+
+import (
+	"testing"
+
+	"connect-companion/config"
+
+	"github.com/google/uuid"
+)
+
+func TestBucket(t *testing.T) {
+	tests := []struct {
+		name       string
+		experiment config.Experiment
+		// Ожидаемая доля каждого варианта, в процентах
+		shares map[string]float64
+	}{
+		{
+			"equal by default",
+			config.Experiment{Name: "greeting", Variants: []config.Variant{{Name: "a"}, {Name: "b"}}},
+			map[string]float64{"a": 50, "b": 50},
+		},
+		{
+			"weighted",
+			config.Experiment{Name: "menu", Variants: []config.Variant{{Name: "a", Weight: 1}, {Name: "b", Weight: 3}}},
+			map[string]float64{"a": 25, "b": 75},
+		},
+		{
+			"single",
+			config.Experiment{Name: "single", Variants: []config.Variant{{Name: "only"}}},
+			map[string]float64{"only": 100},
+		},
+	}
+
+	const users = 20000
+
+	for _, test := range tests {
+		counts := map[string]int{}
+		for i := 0; i < users; i++ {
+			userId := uuid.New()
+
+			variant := Bucket(test.experiment, userId)
+			if again := Bucket(test.experiment, userId); again != variant {
+				t.Fatalf("%s: user moved from %s to %s", test.name, variant, again)
+			}
+			counts[variant]++
+		}
+
+		for variant, share := range test.shares {
+			got := float64(counts[variant]) * 100 / users
+			if got < share-2 || got > share+2 {
+				t.Errorf("%s: variant %s got %.1f%%, want about %.0f%%", test.name, variant, got, share)
+			}
+		}
+		if len(counts) != len(test.shares) {
+			t.Errorf("%s: unexpected variants %v", test.name, counts)
+		}
+	}
+}
+
+func TestAssignKeepsVariant(t *testing.T) {
+	list = []config.Experiment{
+		{Name: "greeting", Variants: []config.Variant{{Name: "a"}, {Name: "b"}}},
+	}
+	defer func() { list = nil }()
+
+	assigned := map[string]string{"greeting": "custom"}
+	if added := Assign(assigned, uuid.New()); len(added) != 0 || assigned["greeting"] != "custom" {
+		t.Errorf("assigned variant changed: %v, added %v", assigned, added)
+	}
+
+	assigned = map[string]string{}
+	if added := Assign(assigned, uuid.New()); len(added) != 1 || assigned["greeting"] == "" {
+		t.Errorf("new chat not assigned: %v, added %v", assigned, added)
+	}
+}
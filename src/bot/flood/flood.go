@@ -0,0 +1,358 @@
+package flood
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	// Сообщение обрабатывается как обычно
+	ALLOW = iota
+	// Лимит превышен: пользователя нужно попросить писать реже
+	SLOW_DOWN
+	// Сообщение игнорируется без ответа
+	DROP
+
+	DEFAULT_WINDOW = time.Minute
+
+	// Сколько помнить прошлые блокировки для увеличения следующей
+	STRIKES_TTL = 24 * time.Hour
+
+	SOURCE_CONFIG = "config"
+	SOURCE_ADMIN  = "admin"
+)
+
+type (
+	// Blocked - пользователь в черном списке и откуда он туда попал
+	Blocked struct {
+		UserId uuid.UUID `json:"user_id" format:"uuid"`
+		Source string    `json:"source" example:"admin"`
+	}
+
+	// Mute - временная блокировка за флуд
+	Mute struct {
+		UserId uuid.UUID `json:"user_id" format:"uuid"`
+		Until  time.Time `json:"until"`
+	}
+
+	bucket struct {
+		tokens  float64
+		updated time.Time
+	}
+
+	// limiter - token bucket на каждый ключ в памяти процесса
+	limiter struct {
+		mu      sync.Mutex
+		rate    float64
+		burst   float64
+		buckets map[uuid.UUID]*bucket
+		swept   time.Time
+	}
+)
+
+var (
+	users *limiter
+	lines *limiter
+
+	window  = DEFAULT_WINDOW
+	mute    time.Duration
+	maxMute time.Duration
+
+	blocklist = map[uuid.UUID]bool{}
+)
+
+// Configure проверяет лимиты из конфигурации. Нулевой rate отключает лимит
+func Configure(cnf *config.Conf) error {
+	f := cnf.Flood
+
+	for name, limit := range map[string]config.RateLimit{"user": f.User, "line": f.Line} {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return fmt.Errorf("flood %s: rate and burst must not be negative", name)
+		}
+		if limit.Rate > 0 && limit.Burst == 0 {
+			return fmt.Errorf("flood %s: burst is required", name)
+		}
+	}
+	if f.Mute < 0 || f.MaxMute < 0 || f.Window < 0 {
+		return fmt.Errorf("flood: durations must not be negative")
+	}
+
+	users = newLimiter(f.User)
+	lines = newLimiter(f.Line)
+
+	window = f.Window
+	if window == 0 {
+		window = DEFAULT_WINDOW
+	}
+
+	mute = f.Mute
+	maxMute = f.MaxMute
+	if maxMute < mute {
+		maxMute = mute
+	}
+
+	blocklist = map[uuid.UUID]bool{}
+	for _, userId := range f.Blocklist {
+		blocklist[userId] = true
+	}
+
+	return nil
+}
+
+func newLimiter(limit config.RateLimit) *limiter {
+	if limit.Rate == 0 {
+		return nil
+	}
+
+	return &limiter{
+		rate:    limit.Rate,
+		burst:   float64(limit.Burst),
+		buckets: map[uuid.UUID]*bucket{},
+	}
+}
+
+// allow забирает токен из корзины ключа
+func (l *limiter) allow(key uuid.UUID, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.updated).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// sweep раз в минуту удаляет полные корзины - они ничем не отличаются от новых
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Check решает, что делать с очередным сообщением пользователя
+func Check(db redis.UniversalClient, lineId uuid.UUID, userId uuid.UUID) int {
+	if IsBlocked(db, userId) {
+		return DROP
+	}
+
+	muted, err := db.Exists(mutePrefix() + userId.String()).Result()
+	if err != nil {
+		logger.Warning("Error while check mute", err)
+	} else if muted > 0 {
+		return DROP
+	}
+
+	now := time.Now()
+
+	if !users.allow(userId, now) {
+		if notify(db, userId) {
+			return SLOW_DOWN
+		}
+
+		// Предупреждение в этом окне уже было, а сообщения продолжаются
+		punish(db, userId)
+
+		return DROP
+	}
+
+	if !lines.allow(lineId, now) {
+		if notify(db, userId) {
+			return SLOW_DOWN
+		}
+
+		return DROP
+	}
+
+	return ALLOW
+}
+
+// notify возвращает true не чаще раза в окно на пользователя
+func notify(db redis.UniversalClient, userId uuid.UUID) bool {
+	ok, err := db.SetNX(noticePrefix()+userId.String(), 1, window).Result()
+	if err != nil {
+		logger.Warning("Error while mark flood notice", err)
+
+		return false
+	}
+
+	return ok
+}
+
+// punish блокирует пользователя на mute, каждая следующая блокировка за сутки - вдвое дольше
+func punish(db redis.UniversalClient, userId uuid.UUID) {
+	if mute == 0 {
+		return
+	}
+
+	key := strikePrefix() + userId.String()
+
+	strikes, err := db.Incr(key).Result()
+	if err != nil {
+		logger.Warning("Error while count flood strikes", err)
+		strikes = 1
+	}
+	db.Expire(key, STRIKES_TTL)
+
+	duration := mute
+	for i := int64(1); i < strikes && duration < maxMute; i++ {
+		duration *= 2
+	}
+	if duration > maxMute {
+		duration = maxMute
+	}
+
+	logger.Info("User", userId.String(), "muted for", duration, "strike", strikes)
+
+	if err = db.Set(mutePrefix()+userId.String(), 1, duration).Err(); err != nil {
+		logger.Warning("Error while mute user", err)
+	}
+}
+
+// IsBlocked проверяет черный список из конфигурации и из админки
+func IsBlocked(db redis.UniversalClient, userId uuid.UUID) bool {
+	if blocklist[userId] {
+		return true
+	}
+
+	blocked, err := db.SIsMember(blocklistKey(), userId.String()).Result()
+	if err != nil {
+		logger.Warning("Error while check blocklist", err)
+
+		return false
+	}
+
+	return blocked
+}
+
+func Block(db redis.UniversalClient, userId uuid.UUID) error {
+	return db.SAdd(blocklistKey(), userId.String()).Err()
+}
+
+// Unblock убирает пользователя из списка админки. Записи из конфигурации так не удалить
+func Unblock(db redis.UniversalClient, userId uuid.UUID) error {
+	return db.SRem(blocklistKey(), userId.String()).Err()
+}
+
+func Blocklist(db redis.UniversalClient) ([]Blocked, error) {
+	members, err := db.SMembers(blocklistKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Blocked, 0, len(blocklist)+len(members))
+	for userId := range blocklist {
+		list = append(list, Blocked{UserId: userId, Source: SOURCE_CONFIG})
+	}
+	for _, member := range members {
+		userId, err := uuid.Parse(member)
+		if err != nil || blocklist[userId] {
+			continue
+		}
+		list = append(list, Blocked{UserId: userId, Source: SOURCE_ADMIN})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UserId.String() < list[j].UserId.String()
+	})
+
+	return list, nil
+}
+
+// Mutes возвращает действующие временные блокировки
+func Mutes(db redis.UniversalClient) ([]Mute, error) {
+	var list []Mute
+
+	err := database.ScanKeys(db, mutePrefix()+"*", func(key string) error {
+		userId, err := uuid.Parse(strings.TrimPrefix(key, mutePrefix()))
+		if err != nil {
+			return nil
+		}
+
+		left, err := db.TTL(key).Result()
+		if err != nil || left <= 0 {
+			return nil
+		}
+
+		list = append(list, Mute{UserId: userId, Until: time.Now().Add(left).Round(time.Second)})
+
+		return nil
+	})
+
+	return list, err
+}
+
+// Unmute снимает временную блокировку и забывает прошлые. Ключи удаляются
+// по одному: в кластере они лежат в разных слотах
+func Unmute(db redis.UniversalClient, userId uuid.UUID) error {
+	for _, key := range []string{mutePrefix(), strikePrefix(), noticePrefix()} {
+		if err := db.Del(key + userId.String()).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func blocklistKey() string {
+	return database.PREFIX_FLOOD + "blocklist"
+}
+
+func mutePrefix() string {
+	return database.PREFIX_FLOOD + "mute:"
+}
+
+func noticePrefix() string {
+	return database.PREFIX_FLOOD + "notice:"
+}
+
+func strikePrefix() string {
+	return database.PREFIX_FLOOD + "strikes:"
+}
+
+// MuteOf возвращает действующую временную блокировку пользователя или nil
+func MuteOf(db redis.UniversalClient, userId uuid.UUID) (*Mute, error) {
+	left, err := db.TTL(mutePrefix() + userId.String()).Result()
+	if err != nil || left <= 0 {
+		return nil, err
+	}
+
+	return &Mute{UserId: userId, Until: time.Now().Add(left).Round(time.Second)}, nil
+}
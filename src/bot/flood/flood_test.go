@@ -0,0 +1,82 @@
+package flood
+
+import (
+	"testing"
+	"time"
+
+	"connect-companion/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+func setup(t *testing.T, f config.Flood) redis.UniversalClient {
+	t.Helper()
+
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mini.Close)
+
+	if err = Configure(&config.Conf{Flood: f}); err != nil {
+		t.Fatal(err)
+	}
+
+	return redis.NewClient(&redis.Options{Addr: mini.Addr()})
+}
+
+func TestCheck(t *testing.T) {
+	userLimit := config.RateLimit{Rate: 0.001, Burst: 2}
+
+	tests := []struct {
+		name  string
+		flood config.Flood
+		want  []int
+	}{
+		{"no limits", config.Flood{}, []int{ALLOW, ALLOW, ALLOW, ALLOW}},
+		{"user limit without mute", config.Flood{User: userLimit}, []int{ALLOW, ALLOW, SLOW_DOWN, DROP, DROP}},
+		{"user limit with mute", config.Flood{User: userLimit, Mute: time.Minute}, []int{ALLOW, ALLOW, SLOW_DOWN, DROP, DROP}},
+		{"line limit", config.Flood{Line: config.RateLimit{Rate: 0.001, Burst: 1}}, []int{ALLOW, SLOW_DOWN, DROP}},
+	}
+
+	for _, test := range tests {
+		db := setup(t, test.flood)
+		lineId, userId := uuid.New(), uuid.New()
+
+		for i, want := range test.want {
+			if got := Check(db, lineId, userId); got != want {
+				t.Errorf("%s: message %d got %d, want %d", test.name, i+1, got, want)
+			}
+		}
+
+		muted, _ := MuteOf(db, userId)
+		if (muted != nil) != (test.flood.Mute > 0) {
+			t.Errorf("%s: mute %v", test.name, muted)
+		}
+	}
+}
+
+func TestCheckBlocked(t *testing.T) {
+	configured := uuid.New()
+	db := setup(t, config.Flood{Blocklist: []uuid.UUID{configured}})
+
+	added := uuid.New()
+	if err := Block(db, added); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userId := range []uuid.UUID{configured, added} {
+		if got := Check(db, uuid.New(), userId); got != DROP {
+			t.Errorf("blocked %s: got %d", userId, got)
+		}
+	}
+
+	if err := Unblock(db, added); err != nil {
+		t.Fatal(err)
+	}
+	if got := Check(db, uuid.New(), added); got != ALLOW {
+		t.Errorf("unblocked: got %d", got)
+	}
+}
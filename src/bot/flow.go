@@ -0,0 +1,372 @@
+package bot
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	"connect-companion/bot/experiments"
+	"connect-companion/bot/messages"
+	"connect-companion/bot/requests"
+	"connect-companion/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Сколько состояний помнит история навигации
+	NAVIGATION_DEPTH = 10
+
+	KEY_BACK      = "back"
+	KEY_MAIN_MENU = "menu"
+
+	KEY_PAGE_NEXT = "page_next"
+	KEY_PAGE_PREV = "page_prev"
+)
+
+type (
+	// Action - реакция бота на пункт меню или ввод пользователя
+	Action func(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error)
+
+	// Option - пункт меню состояния. Выбирается по Id кнопки, ее тексту или синонимам
+	Option struct {
+		Id      string
+		Text    string
+		Aliases []string
+		Topic   string
+
+		// Переход в состояние с показом его приглашения, действие
+		// или зарегистрированное через RegisterAction действие по имени
+		Goto   database.ChatState
+		Do     Action
+		Action string
+
+		// Файл из files_dir, который отправляет пункт, или форма, которую он начинает
+		File string
+		Form string
+	}
+
+	// State - состояние диалога: что бот говорит при входе, какие пункты меню
+	// предлагает и как реагирует на остальной ввод
+	State struct {
+		Id         database.ChatState
+		Name       string
+		Prompt     string
+		PromptFunc func(msg *messages.Message) string
+		Menu       [][]Option
+
+		// Длинный список пунктов, который раскладывается по Columns кнопок в ряд
+		// и по PageSize пунктов на страницу с кнопками "Далее" и "Назад".
+		// Пункты без Id получают постоянный Id по тексту, поэтому нажатие сохраненной
+		// в чате кнопки находит тот же пункт, даже если список изменился
+		Catalog  []Option
+		Columns  int
+		PageSize int
+
+		// Корневое состояние очищает историю и не показывает кнопки навигации
+		Root bool
+		// Фраза, если ввод не совпал с меню. Пустая - повторяем приглашение
+		Sorry string
+
+		OnText Action
+		OnFile Action
+		// Собственная реакция на "Назад" вместо возврата по истории
+		OnBack Action
+		// Собственный показ состояния вместо Prompt и Menu
+		OnShow func(c *gin.Context, msg *messages.Message, chatState *database.Chat, text string) (database.ChatState, error)
+
+		// В состояние переводит только код (действие или обработчик), а не пункт меню.
+		// На схеме в него ведет узел "обработчик на Go", lint не считает его недостижимым
+		EnteredByCode bool
+	}
+)
+
+var (
+	states = map[database.ChatState]*State{}
+
+	navigationKeys = [][]requests.KeyboardKey{
+		{{Id: KEY_BACK, Text: "Назад"}, {Id: KEY_MAIN_MENU, Text: "В главное меню"}},
+	}
+
+	pagePrevKey = requests.KeyboardKey{Id: KEY_PAGE_PREV, Text: "« Назад"}
+	pageNextKey = requests.KeyboardKey{Id: KEY_PAGE_NEXT, Text: "Далее »"}
+)
+
+func defineStates(list ...*State) {
+	for _, state := range list {
+		mustCompileTemplate(state.Prompt)
+		mustCompileTemplate(state.Sorry)
+
+		for i := range state.Catalog {
+			if state.Catalog[i].Id == "" {
+				state.Catalog[i].Id = stableId(state.Catalog[i].Text)
+			}
+		}
+
+		states[state.Id] = state
+	}
+}
+
+// stableId - короткий Id кнопки, который не зависит от порядка пунктов
+func stableId(text string) string {
+	sum := sha1.Sum([]byte(text))
+
+	return "k" + hex.EncodeToString(sum[:4])
+}
+
+// pages возвращает число страниц каталога
+func (state *State) pages() int {
+	if state.PageSize <= 0 || len(state.Catalog) == 0 {
+		return 1
+	}
+
+	return (len(state.Catalog) + state.PageSize - 1) / state.PageSize
+}
+
+// catalogKeys раскладывает страницу каталога по рядам и добавляет кнопки перелистывания
+func (state *State) catalogKeys(page int) [][]requests.KeyboardKey {
+	if len(state.Catalog) == 0 {
+		return nil
+	}
+
+	items := state.Catalog
+	if state.PageSize > 0 {
+		from := page * state.PageSize
+		to := from + state.PageSize
+		if to > len(items) {
+			to = len(items)
+		}
+		items = items[from:to]
+	}
+
+	columns := state.Columns
+	if columns <= 0 {
+		columns = 1
+	}
+
+	var keyboard [][]requests.KeyboardKey
+	for i := 0; i < len(items); i += columns {
+		end := i + columns
+		if end > len(items) {
+			end = len(items)
+		}
+
+		row := make([]requests.KeyboardKey, 0, columns)
+		for _, option := range items[i:end] {
+			row = append(row, requests.KeyboardKey{Id: option.Id, Text: option.Text})
+		}
+		keyboard = append(keyboard, row)
+	}
+
+	var paging []requests.KeyboardKey
+	if page > 0 {
+		paging = append(paging, pagePrevKey)
+	}
+	if page < state.pages()-1 {
+		paging = append(paging, pageNextKey)
+	}
+	if len(paging) > 0 {
+		keyboard = append(keyboard, paging)
+	}
+
+	return keyboard
+}
+
+// keyboard собирает клавиатуру состояния: страницу каталога, меню и кнопки навигации
+func (state *State) keyboard(page int) *[][]requests.KeyboardKey {
+	keyboard := state.catalogKeys(page)
+
+	for _, row := range state.Menu {
+		keys := make([]requests.KeyboardKey, 0, len(row))
+		for _, option := range row {
+			keys = append(keys, requests.KeyboardKey{Id: option.Id, Text: option.Text})
+		}
+		keyboard = append(keyboard, keys)
+	}
+
+	if !state.Root {
+		keyboard = append(keyboard, navigationKeys...)
+	}
+
+	if len(keyboard) == 0 {
+		return nil
+	}
+
+	return &keyboard
+}
+
+func (state *State) prompt(msg *messages.Message) string {
+	if state.PromptFunc != nil {
+		return state.PromptFunc(msg)
+	}
+
+	return state.Prompt
+}
+
+// match ищет пункт меню или каталога (на любой странице) по нормализованному вводу пользователя
+func (state *State) match(text string) *Option {
+	for i := range state.Catalog {
+		option := &state.Catalog[i]
+		if text == option.Id || text == strings.ToLower(option.Text) {
+			return option
+		}
+		for _, alias := range option.Aliases {
+			if text == alias {
+				return option
+			}
+		}
+	}
+
+	for i := range state.Menu {
+		for j := range state.Menu[i] {
+			option := &state.Menu[i][j]
+			if text == option.Id || text == strings.ToLower(option.Text) {
+				return option
+			}
+			for _, alias := range option.Aliases {
+				if text == alias {
+					return option
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func handleText(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	state, ok := states[chatState.CurrentState]
+	if !ok {
+		return toMainMenu(c, msg, chatState)
+	}
+
+	text := strings.ToLower(strings.TrimSpace(msg.Text))
+
+	if !state.Root {
+		switch text {
+		case KEY_BACK, "назад":
+			if state.OnBack != nil {
+				return state.OnBack(c, msg, chatState)
+			}
+
+			return goBack(c, msg, chatState)
+		case KEY_MAIN_MENU, "в главное меню":
+			return toMainMenu(c, msg, chatState)
+		}
+	}
+
+	if state.PageSize > 0 {
+		switch text {
+		case KEY_PAGE_NEXT, "далее", strings.ToLower(pageNextKey.Text):
+			if chatState.Page < state.pages()-1 {
+				chatState.Page++
+			}
+			return show(c, msg, chatState, state, "")
+		case KEY_PAGE_PREV, strings.ToLower(pagePrevKey.Text):
+			if chatState.Page > 0 {
+				chatState.Page--
+			}
+			return show(c, msg, chatState, state, "")
+		}
+	}
+
+	if option := state.match(text); option != nil {
+		if option.Topic != "" {
+			chatState.Topic = option.Topic
+		}
+		if option.Do != nil {
+			return option.Do(c, msg, chatState)
+		}
+		if option.File != "" {
+			return sendDocument(option.File)(c, msg, chatState)
+		}
+		if option.Form != "" {
+			return startForm(option.Form)(c, msg, chatState)
+		}
+		if option.Action != "" {
+			return runAction(option.Action, c, msg, chatState)
+		}
+
+		return enter(c, msg, chatState, option.Goto)
+	}
+
+	if state.OnText != nil {
+		return state.OnText(c, msg, chatState)
+	}
+
+	countOutcome(c, chatState, experiments.METRIC_FALLBACKS)
+
+	return show(c, msg, chatState, state, state.Sorry)
+}
+
+// enter переводит диалог в состояние, запоминая текущее в истории
+func enter(c *gin.Context, msg *messages.Message, chatState *database.Chat, to database.ChatState) (database.ChatState, error) {
+	to = substitute(chatState, to)
+
+	state, ok := states[to]
+	if !ok {
+		return toMainMenu(c, msg, chatState)
+	}
+
+	if chatState.CurrentState != to {
+		chatState.Page = 0
+	}
+
+	if state.Root {
+		chatState.History = nil
+	} else if _, ok := states[chatState.CurrentState]; ok && chatState.CurrentState != to {
+		chatState.History = append(chatState.History, chatState.CurrentState)
+		if len(chatState.History) > NAVIGATION_DEPTH {
+			chatState.History = chatState.History[len(chatState.History)-NAVIGATION_DEPTH:]
+		}
+	}
+
+	return show(c, msg, chatState, state, "")
+}
+
+// show отправляет приглашение состояния (или text) с его клавиатурой
+func show(c *gin.Context, msg *messages.Message, chatState *database.Chat, state *State, text string) (database.ChatState, error) {
+	state = state.variant(chatState)
+
+	if state.OnShow != nil {
+		return state.OnShow(c, msg, chatState, text)
+	}
+
+	return showPrompt(c, msg, chatState, state, text)
+}
+
+// showPrompt - показ по умолчанию: Prompt (или text) и меню
+func showPrompt(c *gin.Context, msg *messages.Message, chatState *database.Chat, state *State, text string) (database.ChatState, error) {
+	if text == "" {
+		text = state.prompt(msg)
+	}
+
+	page := chatState.Page
+	if page >= state.pages() {
+		page = state.pages() - 1
+	}
+
+	return msg.Send(c, render(c, msg, chatState, text), state.Id, state.keyboard(page))
+}
+
+// goBack возвращает пользователя в предыдущее состояние и повторяет его приглашение
+func goBack(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	for len(chatState.History) > 0 {
+		last := chatState.History[len(chatState.History)-1]
+		chatState.History = chatState.History[:len(chatState.History)-1]
+
+		if state, ok := states[last]; ok && last != chatState.CurrentState {
+			chatState.Page = 0
+
+			return show(c, msg, chatState, state, "")
+		}
+	}
+
+	return toMainMenu(c, msg, chatState)
+}
+
+func toMainMenu(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	chatState.Form = nil
+
+	return enter(c, msg, chatState, database.STATE_MAIN_MENU)
+}
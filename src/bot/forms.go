@@ -0,0 +1,216 @@
+package bot
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"connect-companion/bot/messages"
+	"connect-companion/bot/requests"
+	"connect-companion/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	KEY_SKIP = "skip"
+)
+
+type (
+	// Field - вопрос формы. Ответ после проверки сохраняется в chatState.Vars[Name]
+	Field struct {
+		Name     string
+		Title    string
+		Prompt   string
+		Type     string
+		Pattern  string
+		Choices  []string
+		Optional bool
+		// Фраза при неверном вводе. Пустая - стандартная для типа поля
+		Error string
+
+		pattern *regexp.Regexp
+	}
+
+	// Form - последовательность вопросов. После последнего ответа вызывается
+	// OnComplete, собранные данные лежат в chatState.Vars и удаляются после него
+	Form struct {
+		Name       string
+		Title      string
+		Fields     []Field
+		OnComplete Action
+	}
+)
+
+var (
+	forms = map[string]*Form{}
+
+	fieldErrors = map[string]string{
+		FIELD_TEXT:       "Ответ не может быть пустым.",
+		FIELD_DATE:       "Не получилось распознать дату. Введите ее в формате ДД.ММ.ГГГГ.",
+		FIELD_DATE_RANGE: "Не получилось распознать период. Введите его в формате ДД.ММ.ГГГГ - ДД.ММ.ГГГГ.",
+		FIELD_PHONE:      "Не получилось распознать номер. Введите его в формате +7 999 123-45-67.",
+		FIELD_EMAIL:      "Не получилось распознать адрес. Введите его в формате name@example.ru.",
+		FIELD_NUMBER:     "Введите, пожалуйста, число.",
+		FIELD_REGEX:      "Ответ не подходит по формату.",
+		FIELD_CHOICE:     "Выберите, пожалуйста, один из вариантов.",
+	}
+)
+
+// defineForms регистрирует формы. Ошибки в описании полей - ошибки программиста,
+// поэтому приводят к панике при старте
+func defineForms(list ...*Form) {
+	for _, form := range list {
+		for i := range form.Fields {
+			field := &form.Fields[i]
+			mustCompileTemplate(field.Prompt)
+			if _, ok := validators[field.Type]; !ok {
+				panic("form " + form.Name + ": unknown type " + field.Type + " of field " + field.Name)
+			}
+			if field.Type == FIELD_REGEX {
+				field.pattern = regexp.MustCompile(field.Pattern)
+			}
+		}
+
+		forms[form.Name] = form
+	}
+}
+
+// startForm начинает заполнение формы с первого вопроса
+func startForm(name string) Action {
+	return func(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+		chatState.Form = &database.FormProgress{Name: name}
+
+		return enter(c, msg, chatState, database.STATE_FORM)
+	}
+}
+
+func currentField(chatState *database.Chat) (*Form, *Field) {
+	if chatState.Form == nil {
+		return nil, nil
+	}
+
+	form, ok := forms[chatState.Form.Name]
+	if !ok || chatState.Form.Field < 0 || chatState.Form.Field >= len(form.Fields) {
+		return form, nil
+	}
+
+	return form, &form.Fields[chatState.Form.Field]
+}
+
+// askField задает текущий вопрос формы, text добавляется перед вопросом
+func askField(c *gin.Context, msg *messages.Message, chatState *database.Chat, text string) (database.ChatState, error) {
+	_, field := currentField(chatState)
+	if field == nil {
+		return toMainMenu(c, msg, chatState)
+	}
+
+	prompt := render(c, msg, chatState, field.Prompt)
+	if text != "" {
+		prompt = text + "\n" + prompt
+	}
+
+	var keyboard [][]requests.KeyboardKey
+	for i, choice := range field.Choices {
+		keyboard = append(keyboard, []requests.KeyboardKey{{Id: strconv.Itoa(i + 1), Text: choice}})
+	}
+	if field.Optional {
+		keyboard = append(keyboard, []requests.KeyboardKey{{Id: KEY_SKIP, Text: "Пропустить"}})
+	}
+	keyboard = append(keyboard, navigationKeys...)
+
+	return msg.Send(c, prompt, database.STATE_FORM, &keyboard)
+}
+
+func formInput(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	form, field := currentField(chatState)
+	if field == nil {
+		return toMainMenu(c, msg, chatState)
+	}
+
+	input := strings.TrimSpace(msg.Text)
+
+	var value string
+	if lower := strings.ToLower(input); field.Optional && (lower == KEY_SKIP || lower == "пропустить") {
+		value = ""
+	} else {
+		var err error
+		if value, err = validators[field.Type](field, input); err != nil {
+			return askField(c, msg, chatState, fieldError(field))
+		}
+	}
+
+	if chatState.Vars == nil {
+		chatState.Vars = map[string]string{}
+	}
+	chatState.Vars[field.Name] = value
+	chatState.Form.Field++
+
+	if chatState.Form.Field < len(form.Fields) {
+		return askField(c, msg, chatState, "")
+	}
+
+	done := chatState.Form
+	next, err := form.OnComplete(c, msg, chatState)
+	if chatState.Form == done {
+		chatState.Form = nil
+	}
+
+	// Ответы (телефон, e-mail, даты) уже переданы, хранить их в состоянии чата незачем
+	for _, field := range form.Fields {
+		delete(chatState.Vars, field.Name)
+	}
+
+	return next, err
+}
+
+// formBack возвращает к предыдущему вопросу, а с первого - из формы
+func formBack(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	if chatState.Form != nil && chatState.Form.Field > 0 {
+		chatState.Form.Field--
+
+		return askField(c, msg, chatState, "")
+	}
+
+	chatState.Form = nil
+
+	return goBack(c, msg, chatState)
+}
+
+func fieldError(field *Field) string {
+	if field.Error != "" {
+		return field.Error
+	}
+
+	return fieldErrors[field.Type]
+}
+
+// formSummary перечисляет ответы заполняемой формы
+func formSummary(chatState *database.Chat) string {
+	if chatState.Form == nil {
+		return ""
+	}
+	form, ok := forms[chatState.Form.Name]
+	if !ok {
+		return ""
+	}
+
+	var summary strings.Builder
+	summary.WriteString(form.Title)
+	for _, field := range form.Fields {
+		value := chatState.Vars[field.Name]
+		if value == "" {
+			value = "-"
+		}
+		summary.WriteString("\n" + field.Title + ": " + value)
+	}
+
+	return summary.String()
+}
+
+// submitForm отправляет сводку ответов в чат и переводит обращение на специалиста
+func submitForm(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	_, _ = msg.Send(c, formSummary(chatState), database.STATE_FORM, nil)
+
+	return reroute(c, msg, chatState)
+}
@@ -0,0 +1,262 @@
+package bot
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"connect-companion/bot/messages"
+	"connect-companion/bot/requests"
+	"connect-companion/config"
+	"connect-companion/database"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// Номера состояний от этого значения зарезервированы для расширений
+	STATE_CUSTOM_BASE = 10000
+
+	ACTION_CLOSE     = "close"
+	ACTION_REROUTE   = "reroute"
+	ACTION_MAIN_MENU = "main_menu"
+	ACTION_BACK      = "back"
+)
+
+type (
+	// Handler - обработчик на Go для именованного состояния или действия.
+	// Возвращает состояние, в котором окажется диалог.
+	//
+	//	bot.RegisterAction("salary_balance", func(ctx *bot.Context) (database.ChatState, error) {
+	//		balance, err := payroll.Balance(ctx.Message.UserId)
+	//		if err != nil {
+	//			return ctx.Reroute()
+	//		}
+	//		ctx.SetVar("balance", balance)
+	//		return ctx.Reply("Остаток отпуска: " + balance + " дн.")
+	//	})
+	Handler func(ctx *Context) (database.ChatState, error)
+
+	// Context - входящее сообщение, состояние чата и методы ответа для Handler
+	Context struct {
+		Gin     *gin.Context
+		Message *messages.Message
+		Chat    *database.Chat
+	}
+)
+
+var (
+	actions = map[string]Handler{}
+)
+
+func init() {
+	RegisterAction(ACTION_CLOSE, func(ctx *Context) (database.ChatState, error) {
+		return ctx.Close()
+	})
+	RegisterAction(ACTION_REROUTE, func(ctx *Context) (database.ChatState, error) {
+		return ctx.Reroute()
+	})
+	RegisterAction(ACTION_MAIN_MENU, func(ctx *Context) (database.ChatState, error) {
+		return ctx.MainMenu()
+	})
+	RegisterAction(ACTION_BACK, func(ctx *Context) (database.ChatState, error) {
+		return ctx.Back()
+	})
+}
+
+// RegisterAction связывает имя действия с обработчиком. Пункт меню вызывает его
+// через Option{Action: name}. Регистрировать нужно до запуска приложения.
+func RegisterAction(name string, handler Handler) {
+	if _, ok := actions[name]; ok {
+		panic("bot: action " + name + " already registered")
+	}
+
+	actions[name] = handler
+}
+
+// RegisterState добавляет состояние. Для своих состояний используйте номера
+// от STATE_CUSTOM_BASE, чтобы не пересечься со встроенными.
+func RegisterState(state *State) {
+	if _, ok := states[state.Id]; ok {
+		panic(fmt.Sprintf("bot: state %d already registered", state.Id))
+	}
+	if _, ok := stateByName(state.Name); ok {
+		panic("bot: state " + state.Name + " already registered")
+	}
+
+	defineStates(state)
+}
+
+// HandleState передает обработчику ввод в именованном состоянии, не совпавший с его меню
+func HandleState(name string, handler Handler) {
+	state, ok := stateByName(name)
+	if !ok {
+		panic("bot: unknown state " + name)
+	}
+
+	state.OnText = handler.action()
+}
+
+// AddOption добавляет строку меню в именованное состояние перед его последней строкой
+// (обычно "Закрыть" и "Перевести на специалиста" остаются внизу)
+func AddOption(name string, row ...Option) {
+	state, ok := stateByName(name)
+	if !ok {
+		panic("bot: unknown state " + name)
+	}
+
+	if len(state.Menu) == 0 {
+		state.Menu = append(state.Menu, row)
+		return
+	}
+
+	last := len(state.Menu) - 1
+	state.Menu = append(state.Menu[:last], append([][]Option{row}, state.Menu[last:]...)...)
+}
+
+// RegisterForm добавляет форму, которую можно начать через Context.StartForm
+func RegisterForm(form *Form) {
+	if _, ok := forms[form.Name]; ok {
+		panic("bot: form " + form.Name + " already registered")
+	}
+
+	defineForms(form)
+}
+
+// StateId возвращает номер состояния по имени
+func StateId(name string) (database.ChatState, bool) {
+	state, ok := stateByName(name)
+	if !ok {
+		return database.STATE_DUMMY, false
+	}
+
+	return state.Id, true
+}
+
+// StateName возвращает имя состояния или его номер, если состояние не описано
+func StateName(id database.ChatState) string {
+	if state, ok := states[id]; ok {
+		return state.Name
+	}
+
+	return strconv.Itoa(int(id))
+}
+
+func stateByName(name string) (*State, bool) {
+	for _, state := range states {
+		if state.Name == name {
+			return state, true
+		}
+	}
+
+	return nil, false
+}
+
+func (handler Handler) action() Action {
+	return func(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+		return handler(&Context{Gin: c, Message: msg, Chat: chatState})
+	}
+}
+
+// runAction вызывает зарегистрированное действие по имени
+func runAction(name string, c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	handler, ok := actions[name]
+	if !ok {
+		return chatState.CurrentState, fmt.Errorf("unknown action %q", name)
+	}
+
+	return handler.action()(c, msg, chatState)
+}
+
+func (ctx *Context) Config() *config.Conf {
+	return ctx.Gin.MustGet("cnf").(*config.Conf)
+}
+
+func (ctx *Context) Redis() redis.UniversalClient {
+	return ctx.Gin.MustGet("db").(redis.UniversalClient)
+}
+
+// Text возвращает введенный пользователем текст без пробелов по краям
+func (ctx *Context) Text() string {
+	return strings.TrimSpace(ctx.Message.Text)
+}
+
+func (ctx *Context) Var(name string) string {
+	return ctx.Chat.Vars[name]
+}
+
+// SetVar сохраняет переменную чата вместе с его состоянием
+func (ctx *Context) SetVar(name string, value string) {
+	if ctx.Chat.Vars == nil {
+		ctx.Chat.Vars = map[string]string{}
+	}
+
+	ctx.Chat.Vars[name] = value
+}
+
+// Send отправляет сообщение, не меняя состояние. Текст с {{ - шаблон, как тексты из конфигурации
+func (ctx *Context) Send(text string, keyboard *[][]requests.KeyboardKey) error {
+	text, err := renderOnce(ctx.Gin, ctx.Message, ctx.Chat, text)
+	if err != nil {
+		return err
+	}
+
+	_, err = ctx.Message.Send(ctx.Gin, text, ctx.Chat.CurrentState, keyboard)
+
+	return err
+}
+
+// SendFile отправляет файл из files_dir, не меняя состояние
+func (ctx *Context) SendFile(fileName string, comment string) error {
+	filePath, err := filepath.Abs(filepath.Join(ctx.Config().FilesDir, fileName))
+	if err != nil {
+		return err
+	}
+
+	if comment, err = renderOnce(ctx.Gin, ctx.Message, ctx.Chat, comment); err != nil {
+		return err
+	}
+	_, err = ctx.Message.SendFile(ctx.Gin, fileName, filePath, &comment, ctx.Chat.CurrentState, nil)
+
+	return err
+}
+
+// Goto переводит диалог в состояние и показывает его приглашение и меню
+func (ctx *Context) Goto(state database.ChatState) (database.ChatState, error) {
+	return enter(ctx.Gin, ctx.Message, ctx.Chat, state)
+}
+
+// Reply отвечает текстом, оставаясь в текущем состоянии с его меню
+func (ctx *Context) Reply(text string) (database.ChatState, error) {
+	state, ok := states[ctx.Chat.CurrentState]
+	if !ok {
+		return ctx.Message.Send(ctx.Gin, text, ctx.Chat.CurrentState, nil)
+	}
+
+	return show(ctx.Gin, ctx.Message, ctx.Chat, state, text)
+}
+
+func (ctx *Context) Back() (database.ChatState, error) {
+	return goBack(ctx.Gin, ctx.Message, ctx.Chat)
+}
+
+func (ctx *Context) MainMenu() (database.ChatState, error) {
+	return toMainMenu(ctx.Gin, ctx.Message, ctx.Chat)
+}
+
+// Reroute переводит на специалиста по правилам маршрутизации с учетом рабочего времени
+func (ctx *Context) Reroute() (database.ChatState, error) {
+	return reroute(ctx.Gin, ctx.Message, ctx.Chat)
+}
+
+// Close закрывает обращение (с опросом, если он включен)
+func (ctx *Context) Close() (database.ChatState, error) {
+	return closeTreatment(ctx.Gin, ctx.Message, ctx.Chat)
+}
+
+// StartForm начинает заполнение зарегистрированной формы
+func (ctx *Context) StartForm(name string) (database.ChatState, error) {
+	return startForm(name)(ctx.Gin, ctx.Message, ctx.Chat)
+}
@@ -1,13 +1,43 @@
 package bot
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"connect-companion/bot/client"
+	"connect-companion/config"
 	"connect-companion/logger"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
+const (
+	DEFAULT_HOOK_CHECK_INTERVAL = 5 * time.Minute
+	HOOK_FIRST_RETRY_DELAY      = 5 * time.Second
+)
+
+type (
+	// HookStatus - состояние регистрации хука на линии
+	HookStatus struct {
+		LineId     uuid.UUID `json:"line_id" format:"uuid"`
+		Registered bool      `json:"registered"`
+		Error      string    `json:"error,omitempty"`
+		// Неудачных попыток подряд
+		Failures    int       `json:"failures"`
+		UpdatedAt   time.Time `json:"updated_at"`
+		NextAttempt time.Time `json:"next_attempt"`
+	}
+)
+
+var (
+	hooksMu sync.Mutex
+	hooks   = map[uuid.UUID]*HookStatus{}
+
+	resync = map[uuid.UUID]chan struct{}{}
+)
+
 func InitHooks(app *gin.Engine, lines []uuid.UUID) {
 	logger.Info("Init receiving endpoint...")
 
@@ -22,6 +52,7 @@ func InitHooks(app *gin.Engine, lines []uuid.UUID) {
 		if err != nil {
 			logger.Warning("Error while setup hook:", err)
 		}
+		setHookStatus(lines[i], err == nil, err)
 	}
 }
 
@@ -33,5 +64,142 @@ func DestroyHooks(lines []uuid.UUID) {
 		if err != nil {
 			logger.Warning("Error while delete hook:", err)
 		}
+		setHookStatus(lines[i], false, err)
 	}
 }
+
+// StartHookReconciler следит, чтобы на каждой линии был установлен хук бота: раз
+// в hooks.check_interval проверяет хук и устанавливает заново, если его нет, а после
+// ошибки повторяет установку через 5, 10, 20... секунд. Возвращает функцию, которая ждет
+// остановки по ctx: после нее хуки можно удалять, не опасаясь, что их установят снова
+func StartHookReconciler(ctx context.Context, cnf *config.Conf) (wait func()) {
+	interval := cnf.Hooks.CheckInterval
+	if interval <= 0 {
+		interval = DEFAULT_HOOK_CHECK_INTERVAL
+	}
+
+	var running sync.WaitGroup
+	for _, lineId := range cnf.Line {
+		wake := make(chan struct{}, 1)
+		resync[lineId] = wake
+
+		running.Add(1)
+		go func(lineId uuid.UUID) {
+			defer running.Done()
+			reconcileHook(ctx, lineId, interval, wake)
+		}(lineId)
+	}
+
+	return running.Wait
+}
+
+func reconcileHook(ctx context.Context, lineId uuid.UUID, interval time.Duration, wake chan struct{}) {
+	for {
+		forced := false
+
+		delay := interval
+		if failures := hookFailures(lineId); failures > 0 {
+			delay = HOOK_FIRST_RETRY_DELAY
+			for i := 1; i < failures && delay < interval; i++ {
+				delay *= 2
+			}
+			if delay > interval {
+				delay = interval
+			}
+		}
+
+		hooksMu.Lock()
+		if status, ok := hooks[lineId]; ok {
+			status.NextAttempt = time.Now().Add(delay)
+		}
+		hooksMu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+			timer.Stop()
+			forced = true
+		case <-timer.C:
+		}
+
+		// Установленный хук не устанавливаем заново, а только проверяем
+		if !forced && hookFailures(lineId) == 0 {
+			registered, err := client.HookRegistered(lineId)
+			if err != nil {
+				logger.Warning("Error while check hook for line", lineId.String(), ":", err)
+				setHookStatus(lineId, false, err)
+
+				continue
+			}
+			if registered {
+				setHookStatus(lineId, true, nil)
+
+				continue
+			}
+			logger.Warning("Hook for line", lineId.String(), "is missing, setup again")
+		}
+
+		_, err := client.SetHook(lineId)
+		if err != nil {
+			logger.Warning("Error while setup hook for line", lineId.String(), ":", err)
+		}
+		setHookStatus(lineId, err == nil, err)
+	}
+}
+
+// ResyncHooks немедленно повторяет установку хуков на всех линиях
+func ResyncHooks() {
+	for _, wake := range resync {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func hookFailures(lineId uuid.UUID) int {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	if status, ok := hooks[lineId]; ok {
+		return status.Failures
+	}
+
+	return 0
+}
+
+func setHookStatus(lineId uuid.UUID, registered bool, err error) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	status := &HookStatus{LineId: lineId, Registered: registered, UpdatedAt: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+		if prev, ok := hooks[lineId]; ok {
+			status.Failures = prev.Failures
+		}
+		status.Failures++
+	}
+
+	hooks[lineId] = status
+}
+
+// HooksStatus возвращает состояние хуков на линиях в порядке lines
+func HooksStatus(lines []uuid.UUID) []HookStatus {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	list := make([]HookStatus, 0, len(lines))
+	for _, lineId := range lines {
+		if status, ok := hooks[lineId]; ok {
+			list = append(list, *status)
+		} else {
+			list = append(list, HookStatus{LineId: lineId})
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,266 @@
+package bot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+)
+
+const (
+	LINT_ERROR   = "error"
+	LINT_WARNING = "warning"
+)
+
+type (
+	// Issue - ошибка в описании диалогов, найденная до того, как на нее наткнется пользователь
+	Issue struct {
+		Level   string `json:"level"`
+		State   string `json:"state,omitempty"`
+		Message string `json:"message"`
+	}
+)
+
+var (
+	// Слова, которые handleText разбирает раньше меню: навигация в некорневых
+	// состояниях и перелистывание в каталогах
+	navigationInputs = []string{KEY_BACK, "назад", KEY_MAIN_MENU, "в главное меню"}
+	pageInputs       = []string{KEY_PAGE_NEXT, "далее", strings.ToLower(pageNextKey.Text), KEY_PAGE_PREV, strings.ToLower(pagePrevKey.Text)}
+)
+
+func (issue Issue) String() string {
+	if issue.State == "" {
+		return issue.Level + ": " + issue.Message
+	}
+
+	return issue.Level + ": " + issue.State + ": " + issue.Message
+}
+
+// Lint проверяет состояния, формы и тексты: недостижимые состояния, тупики,
+// кнопки без обработчика, отсутствующие файлы и совпадающие синонимы.
+// Вызывать после Configure, чтобы учесть каталог документов из настроек
+func Lint(cnf *config.Conf) []Issue {
+	var issues []Issue
+	report := func(level string, state *State, format string, args ...interface{}) {
+		issue := Issue{Level: level, Message: fmt.Sprintf(format, args...)}
+		if state != nil {
+			issue.State = state.Name
+		}
+		issues = append(issues, issue)
+	}
+
+	files := map[string][]*State{}
+
+	for _, id := range stateIds() {
+		state := states[id]
+
+		lintOptions(state, report)
+
+		for _, option := range state.options() {
+			if option.File != "" {
+				files[option.File] = append(files[option.File], state)
+			}
+		}
+
+		if usesProfile(state.Prompt) {
+			report(LINT_WARNING, state, "prompt uses .User.Name or .User.Fields, but no profile loader is set: they render empty")
+		}
+
+		if len(state.options()) == 0 && state.OnText == nil && state.OnFile == nil && state.OnShow == nil {
+			if state.Root {
+				report(LINT_ERROR, state, "dead end: no menu, no input handlers and no navigation buttons")
+			} else {
+				report(LINT_WARNING, state, "dead end: the only way out is \"Назад\" or \"В главное меню\"")
+			}
+		}
+	}
+
+	// Состояния, которые варианты экспериментов показывают вместо других, достижимы через них
+	substitutes := map[string]bool{}
+	for _, experiment := range cnf.Experiments {
+		for _, variant := range experiment.Variants {
+			for _, to := range variant.States {
+				substitutes[to] = true
+			}
+		}
+	}
+
+	for _, name := range unreachableStates() {
+		if substitutes[name] {
+			continue
+		}
+		state, _ := stateByName(name)
+		report(LINT_WARNING, state, "unreachable from %s; if Go code enters it, set EnteredByCode", STATE_NAME_GREETINGS)
+	}
+
+	for fileName := range captions {
+		if _, ok := files[fileName]; !ok {
+			files[fileName] = nil
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for fileName := range files {
+		names = append(names, fileName)
+	}
+	sort.Strings(names)
+
+	for _, fileName := range names {
+		if usesProfile(captions[fileName]) {
+			report(LINT_WARNING, nil, "caption of %q uses .User.Name or .User.Fields, but no profile loader is set: they render empty", fileName)
+		}
+		if _, err := os.Stat(filepath.Join(cnf.FilesDir, fileName)); err != nil {
+			if len(files[fileName]) == 0 {
+				report(LINT_WARNING, nil, "caption for missing file %q", fileName)
+			}
+			for _, state := range files[fileName] {
+				report(LINT_ERROR, state, "file %q not found in %s", fileName, cnf.FilesDir)
+			}
+		}
+	}
+
+	return issues
+}
+
+// lintOptions проверяет, что каждая кнопка состояния ведет куда-то и выбирается однозначно
+func lintOptions(state *State, report func(level string, state *State, format string, args ...interface{})) {
+	inputs := map[string]string{}
+	if !state.Root {
+		for _, input := range navigationInputs {
+			inputs[input] = "navigation"
+		}
+	}
+	if state.PageSize > 0 {
+		for _, input := range pageInputs {
+			inputs[input] = "paging"
+		}
+	}
+
+	// Владелец - сам пункт, а не его текст: у двух пунктов может быть одинаковый текст
+	owners := map[string]*Option{}
+	claim := func(input string, option *Option) {
+		owner, ok := inputs[input]
+		if ok && owners[input] != option {
+			report(LINT_ERROR, state, "%q of option %q is already taken by %q", input, option.Text, owner)
+			return
+		}
+		inputs[input] = option.Text
+		owners[input] = option
+	}
+
+	for _, option := range state.options() {
+		switch {
+		case option.Do != nil:
+		case option.File != "":
+		case option.Form != "":
+			if _, ok := forms[option.Form]; !ok {
+				report(LINT_ERROR, state, "option %q starts unknown form %q", option.Text, option.Form)
+			}
+		case option.Action != "":
+			if _, ok := actions[option.Action]; !ok {
+				report(LINT_ERROR, state, "option %q runs unregistered action %q", option.Text, option.Action)
+			}
+		default:
+			if _, ok := states[option.Goto]; !ok {
+				report(LINT_ERROR, state, "option %q has no handler: Goto %d is not a defined state", option.Text, option.Goto)
+			}
+		}
+
+		if option.Id == "" {
+			report(LINT_ERROR, state, "option %q has no Id", option.Text)
+		} else {
+			claim(option.Id, option)
+		}
+		claim(strings.ToLower(option.Text), option)
+
+		for _, alias := range option.Aliases {
+			if alias != strings.ToLower(alias) {
+				report(LINT_WARNING, state, "alias %q of option %q never matches: input is compared in lower case", alias, option.Text)
+			}
+			claim(alias, option)
+		}
+	}
+}
+
+// options - пункты каталога и меню в том порядке, в котором их ищет match
+func (state *State) options() []*Option {
+	var options []*Option
+	for i := range state.Catalog {
+		options = append(options, &state.Catalog[i])
+	}
+	for i := range state.Menu {
+		for j := range state.Menu[i] {
+			options = append(options, &state.Menu[i][j])
+		}
+	}
+
+	return options
+}
+
+func stateIds() []database.ChatState {
+	ids := make([]database.ChatState, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// unreachableStates обходит схему диалога от начала обращения. В состояния с EnteredByCode
+// схема ведет из узла кода, поэтому обход начинается и с них
+func unreachableStates() []string {
+	diagram := FlowDiagram()
+
+	next := map[string][]string{}
+	for _, edge := range diagram.Edges {
+		next[edge.From] = append(next[edge.From], edge.To)
+	}
+
+	seen := map[string]bool{STATE_NAME_GREETINGS: true, NODE_NAME_CODE: true}
+	queue := []string{STATE_NAME_GREETINGS, NODE_NAME_CODE}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, to := range next[node] {
+			if !seen[to] {
+				seen[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+
+	var unreachable []string
+	for _, id := range stateIds() {
+		if name := states[id].Name; !seen[name] {
+			unreachable = append(unreachable, name)
+		}
+	}
+
+	return unreachable
+}
+
+// LogLint проверяет описание диалогов при запуске. Возвращает ошибку, если найдены
+// ошибки и включен lint.strict
+func LogLint(cnf *config.Conf) error {
+	errors := 0
+	for _, issue := range Lint(cnf) {
+		logger.Warning("Lint", issue)
+		if issue.Level == LINT_ERROR {
+			errors++
+		}
+	}
+
+	if errors > 0 && cnf.Lint.Strict {
+		return fmt.Errorf("%d errors in dialog flow", errors)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package bot
+
+import (
+	"fmt"
+	"testing"
+
+	"connect-companion/database"
+)
+
+func TestLintOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		menu   [][]Option
+		errors int
+	}{
+		{"distinct options", [][]Option{
+			{{Id: "1", Text: "Памятка", Goto: database.STATE_MAIN_MENU}},
+			{{Id: "2", Text: "Регламент", Aliases: []string{"регламент"}, Goto: database.STATE_MAIN_MENU}},
+		}, 0},
+		{"identical texts", [][]Option{
+			{{Id: "1", Text: "Памятка", Goto: database.STATE_MAIN_MENU}},
+			{{Id: "2", Text: "Памятка", Goto: database.STATE_MAIN_MENU}},
+		}, 1},
+		{"same alias", [][]Option{
+			{{Id: "1", Text: "Памятка", Aliases: []string{"док"}, Goto: database.STATE_MAIN_MENU}},
+			{{Id: "2", Text: "Регламент", Aliases: []string{"док"}, Goto: database.STATE_MAIN_MENU}},
+		}, 1},
+		{"same id", [][]Option{
+			{{Id: "1", Text: "Памятка", Goto: database.STATE_MAIN_MENU}},
+			{{Id: "1", Text: "Регламент", Goto: database.STATE_MAIN_MENU}},
+		}, 1},
+	}
+
+	for _, test := range tests {
+		var errors []string
+		report := func(level string, state *State, format string, args ...interface{}) {
+			if level == LINT_ERROR {
+				errors = append(errors, fmt.Sprintf(format, args...))
+			}
+		}
+
+		lintOptions(&State{Name: "test", Root: true, Menu: test.menu}, report)
+		if len(errors) != test.errors {
+			t.Errorf("%s: got %d errors %q, want %d", test.name, len(errors), errors, test.errors)
+		}
+	}
+}
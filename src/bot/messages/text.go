@@ -1,15 +1,18 @@
 package messages
 
 import (
-	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"mime/multipart"
+	"net/http"
 	"net/textproto"
 	"os"
+	"strings"
 	"time"
 
 	"connect-companion/bot/client"
+	"connect-companion/bot/events"
 	"connect-companion/bot/requests"
 	"connect-companion/config"
 	"connect-companion/database"
@@ -21,6 +24,16 @@ import (
 
 type MessageType int
 
+const (
+	SEND_FILE_DEFAULT_MAX_SIZE = 50 << 20
+)
+
+var (
+	// Pause - задержка между сообщениями подряд, чтобы они пришли пользователю по порядку.
+	// При прогоне сценариев заменяется пустой функцией
+	Pause = time.Sleep
+)
+
 const (
 	MESSAGE_TEXT                    MessageType = 1
 	MESSAGE_CALL_START_TREATMENT    MessageType = 20
@@ -46,7 +59,14 @@ type (
 		Text          string      `json:"text" example:"Привет"`
 		Data          struct {
 			Redirect string `json:"redirect"`
+
+			FileName string `json:"file_name"`
+			FileSize int64  `json:"file_size"`
+			FileUrl  string `json:"file_url"`
 		} `json:"data"`
+
+		// Actor - кто действует через бота, для журнала аудита. Пусто - сам бот
+		Actor string `json:"-"`
 	}
 )
 
@@ -58,6 +78,23 @@ func (msg *Message) checkError(err error, nextState database.ChatState) (databas
 	return nextState, nil
 }
 
+// origin - инициатор вызовов API в ответ на сообщение
+func (msg *Message) origin() *client.Origin {
+	actor := msg.Actor
+	if actor == "" {
+		actor = client.ACTOR_BOT
+	}
+
+	return &client.Origin{Actor: actor, LineId: msg.LineId, UserId: msg.UserId, MessageId: msg.MessageID}
+}
+
+// emit сообщает внешним системам об успешном действии бота
+func (msg *Message) emit(err error, eventType string, data map[string]interface{}) {
+	if err == nil {
+		events.Emit(events.New(eventType, msg.LineId, msg.UserId, data))
+	}
+}
+
 func (msg *Message) Start(nextState database.ChatState) (database.ChatState, error) {
 	data := requests.DropKeyboardRequest{
 		LineID: msg.LineId,
@@ -66,7 +103,7 @@ func (msg *Message) Start(nextState database.ChatState) (database.ChatState, err
 
 	jsonData, err := json.Marshal(data)
 
-	_, err = client.Invoke("POST", "/line/drop/keyboard/", "application/json", jsonData)
+	_, err = client.InvokeFrom(msg.origin(), "POST", "/line/drop/keyboard/", "application/json", jsonData)
 
 	return msg.checkError(err, nextState)
 }
@@ -84,7 +121,7 @@ func (msg *Message) Send(c *gin.Context, text string, nextState database.ChatSta
 
 	jsonData, err := json.Marshal(data)
 
-	_, err = client.Invoke("POST", "/line/send/message/", "application/json", jsonData)
+	_, err = client.InvokeFrom(msg.origin(), "POST", "/line/send/message/", "application/json", jsonData)
 
 	return msg.checkError(err, nextState)
 }
@@ -93,7 +130,7 @@ func (msg *Message) RerouteTreatment(c *gin.Context, text string, nextState data
 	if text != "" {
 		_, _ = msg.Send(c, text, nextState, nil)
 
-		time.Sleep(500 * time.Millisecond)
+		Pause(500 * time.Millisecond)
 	}
 
 	data := requests.TreatmentRequest{
@@ -103,7 +140,24 @@ func (msg *Message) RerouteTreatment(c *gin.Context, text string, nextState data
 
 	jsonData, err := json.Marshal(data)
 
-	_, err = client.Invoke("POST", "/line/appoint/start/", "application/json", jsonData)
+	_, err = client.InvokeFrom(msg.origin(), "POST", "/line/appoint/start/", "application/json", jsonData)
+	msg.emit(err, events.REROUTED, nil)
+
+	return msg.checkError(err, nextState)
+}
+
+// AppointSpec назначает обращение на конкретного специалиста
+func (msg *Message) AppointSpec(specId uuid.UUID, nextState database.ChatState) (database.ChatState, error) {
+	data := requests.TreatmentWithSpecRequest{
+		LineID: msg.LineId,
+		UserId: msg.UserId,
+		SpecId: specId,
+	}
+
+	jsonData, err := json.Marshal(data)
+
+	_, err = client.InvokeFrom(msg.origin(), "POST", "/line/appoint/spec/", "application/json", jsonData)
+	msg.emit(err, events.REROUTED, map[string]interface{}{"spec_id": specId})
 
 	return msg.checkError(err, nextState)
 }
@@ -111,7 +165,7 @@ func (msg *Message) RerouteTreatment(c *gin.Context, text string, nextState data
 func (msg *Message) CloseTreatment(c *gin.Context, text string, nextState database.ChatState) (database.ChatState, error) {
 	_, _ = msg.Send(c, text, nextState, nil)
 
-	time.Sleep(500 * time.Millisecond)
+	Pause(500 * time.Millisecond)
 
 	data := requests.TreatmentRequest{
 		LineID: msg.LineId,
@@ -120,7 +174,8 @@ func (msg *Message) CloseTreatment(c *gin.Context, text string, nextState databa
 
 	jsonData, err := json.Marshal(data)
 
-	_, err = client.Invoke("POST", "/line/drop/treatment/", "application/json", jsonData)
+	_, err = client.InvokeFrom(msg.origin(), "POST", "/line/drop/treatment/", "application/json", jsonData)
+	msg.emit(err, events.CLOSED, map[string]interface{}{"by": "bot"})
 
 	return msg.checkError(err, nextState)
 }
@@ -134,13 +189,16 @@ func (msg *Message) StartAndReroute(nextState database.ChatState) (database.Chat
 
 	jsonData, err := json.Marshal(data)
 
-	_, err = client.Invoke("POST", "/line/appoint/start/", "application/json", jsonData)
+	_, err = client.InvokeFrom(msg.origin(), "POST", "/line/appoint/start/", "application/json", jsonData)
+	msg.emit(err, events.REROUTED, nil)
 
 	return msg.checkError(err, nextState)
 
 }
 
-func (msg *Message) SendFile(c *gin.Context, isImage bool, fileName string, filepath string, comment *string, nextState database.ChatState, keyboard *[][]requests.KeyboardKey) (database.ChatState, error) {
+// SendFile отправляет файл пользователю. Тело запроса формируется потоком, поэтому
+// файл не читается в память целиком; картинки определяются по содержимому.
+func (msg *Message) SendFile(c *gin.Context, fileName string, filepath string, comment *string, nextState database.ChatState, keyboard *[][]requests.KeyboardKey) (database.ChatState, error) {
 	cnf := c.MustGet("cnf").(*config.Conf)
 
 	data := requests.FileRequest{
@@ -153,48 +211,77 @@ func (msg *Message) SendFile(c *gin.Context, isImage bool, fileName string, file
 	}
 
 	jsonData, err := json.Marshal(data)
-
-	body := new(bytes.Buffer)
-	writer := multipart.NewWriter(body)
-
-	metaPartHeader := textproto.MIMEHeader{}
-	metaPartHeader.Set("Content-Disposition", `form-data; name="meta"`)
-	metaPartHeader.Set("Content-Type", "application/json")
-	metaPart, err := writer.CreatePart(metaPartHeader)
 	if err != nil {
 		return msg.checkError(err, nextState)
 	}
-	_, _ = metaPart.Write(jsonData)
 
 	file, err := os.Open(filepath)
 	if err != nil {
 		return msg.checkError(err, nextState)
 	}
-	fileContents, err := ioutil.ReadAll(file)
-	if err != nil {
-		return msg.checkError(err, nextState)
-	}
+	defer file.Close()
+
 	fi, err := file.Stat()
 	if err != nil {
 		return msg.checkError(err, nextState)
 	}
-	_ = file.Close()
 
-	filePart, err := writer.CreateFormFile("file", fi.Name())
-	if err != nil {
-		return msg.checkError(err, nextState)
+	maxSize := cnf.MaxFileSize
+	if maxSize <= 0 {
+		maxSize = SEND_FILE_DEFAULT_MAX_SIZE
+	}
+	if fi.Size() > maxSize {
+		return msg.checkError(fmt.Errorf("%w: %s is %d bytes, limit is %d", client.ErrFileTooLarge, filepath, fi.Size(), maxSize), nextState)
 	}
-	_, _ = filePart.Write(fileContents)
 
-	err = writer.Close()
-	if err != nil {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return msg.checkError(err, nextState)
 	}
-
-	if isImage {
-		_, err = client.Invoke("POST", "/line/send/image/", writer.FormDataContentType(), body.Bytes())
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
 		return msg.checkError(err, nextState)
 	}
-	_, err = client.Invoke("POST", "/line/send/file/", writer.FormDataContentType(), body.Bytes())
+
+	methodUrl := "/line/send/file/"
+	if strings.HasPrefix(http.DetectContentType(head[:n]), "image/") {
+		methodUrl = "/line/send/image/"
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeFileForm(writer, jsonData, fi.Name(), file))
+	}()
+
+	_, err = client.InvokeStreamFrom(msg.origin(), "POST", methodUrl, writer.FormDataContentType(), pr, fi.Size())
+	msg.emit(err, events.FILE_SENT, map[string]interface{}{"file_name": fileName})
+
 	return msg.checkError(err, nextState)
 }
+
+func writeFileForm(writer *multipart.Writer, meta []byte, fileName string, file io.Reader) error {
+	metaPartHeader := textproto.MIMEHeader{}
+	metaPartHeader.Set("Content-Disposition", `form-data; name="meta"`)
+	metaPartHeader.Set("Content-Type", "application/json")
+	metaPart, err := writer.CreatePart(metaPartHeader)
+	if err != nil {
+		return err
+	}
+	if _, err = metaPart.Write(meta); err != nil {
+		return err
+	}
+
+	filePart, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(filePart, file); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,187 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"connect-companion/bot/flood"
+	"connect-companion/bot/messages"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	DEDUPE_TTL = time.Hour
+
+	MIDDLEWARE_FLOOD = "flood"
+)
+
+type (
+	// Middleware оборачивает обработку входящего сообщения. Может ответить сам
+	// и не вызывать next, а вернув ErrIgnore - не сохранять состояние чата
+	Middleware func(next Handler) Handler
+)
+
+var (
+	ErrIgnore = errors.New("message ignored")
+
+	middlewares      []Middleware
+	namedMiddlewares = map[string]Middleware{
+		"logging":   loggingMiddleware,
+		"dedupe":    dedupeMiddleware,
+		"profanity": profanityMiddleware,
+	}
+
+	pipeline Handler = processHandler
+)
+
+// Use добавляет middleware в цепочку. Добавленные раньше выполняются раньше,
+// middleware из конфигурации идут после добавленных в коде
+func Use(m ...Middleware) {
+	middlewares = append(middlewares, m...)
+	pipeline = buildPipeline(middlewares)
+}
+
+// RegisterMiddleware делает middleware доступным по имени в конфигурации
+func RegisterMiddleware(name string, m Middleware) {
+	if _, ok := namedMiddlewares[name]; ok {
+		panic("bot: middleware " + name + " already registered")
+	}
+
+	namedMiddlewares[name] = m
+}
+
+// ConfigureMiddleware добавляет в цепочку middleware, перечисленные в конфигурации
+func ConfigureMiddleware(cnf *config.Conf) error {
+	for _, name := range cnf.Middleware.Inbound {
+		// Флуд и черный список проверяются всегда и раньше всех, в Receive. Имя
+		// оставлено, чтобы не ломать конфигурации, где оно указано
+		if name == MIDDLEWARE_FLOOD {
+			continue
+		}
+
+		m, ok := namedMiddlewares[name]
+		if !ok {
+			return fmt.Errorf("unknown inbound middleware %q", name)
+		}
+
+		Use(m)
+	}
+
+	return nil
+}
+
+func buildPipeline(list []Middleware) Handler {
+	handler := Handler(processHandler)
+	for i := len(list) - 1; i >= 0; i-- {
+		handler = list[i](handler)
+	}
+
+	return handler
+}
+
+func processHandler(ctx *Context) (database.ChatState, error) {
+	return processMessage(ctx.Gin, ctx.Message, ctx.Chat)
+}
+
+func loggingMiddleware(next Handler) Handler {
+	return func(ctx *Context) (database.ChatState, error) {
+		started := time.Now()
+		from := ctx.Chat.CurrentState
+
+		state, err := next(ctx)
+
+		logger.Info("Message", ctx.Message.MessageID.String(), "type", ctx.Message.MessageType, "from", ctx.Message.UserId.String(),
+			"state", from, "->", state, "in", time.Since(started).Round(time.Millisecond))
+
+		return state, err
+	}
+}
+
+// dedupeMiddleware отбрасывает повторную доставку push с тем же message_id.
+// Push без message_id не сравниваются: иначе после первого отбрасывались бы все остальные
+func dedupeMiddleware(next Handler) Handler {
+	return func(ctx *Context) (database.ChatState, error) {
+		if ctx.Message.MessageID == uuid.Nil {
+			return next(ctx)
+		}
+
+		key := database.PREFIX_DEDUPE + ctx.Message.MessageID.String()
+
+		fresh, err := ctx.Redis().SetNX(key, 1, DEDUPE_TTL).Result()
+		if err != nil {
+			logger.Warning("Error while check message duplicate", err)
+		} else if !fresh {
+			logger.Info("Duplicate message", ctx.Message.MessageID.String(), "ignored")
+
+			return ctx.Chat.CurrentState, ErrIgnore
+		}
+
+		return next(ctx)
+	}
+}
+
+// Admit до запуска обработки решает, что делать с сообщением: flood.ALLOW, flood.SLOW_DOWN
+// или flood.DROP. Черный список действует на все сообщения, лимиты частоты - только на текст
+// и файлы, служебные сообщения о начале и закрытии обращения не ограничиваются
+func Admit(c *gin.Context, msg *messages.Message) int {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	switch msg.MessageType {
+	case messages.MESSAGE_TEXT, messages.MESSAGE_FILE:
+		return flood.Check(db, msg.LineId, msg.UserId)
+	}
+
+	if flood.IsBlocked(db, msg.UserId) {
+		return flood.DROP
+	}
+
+	return flood.ALLOW
+}
+
+// SlowDown просит пользователя писать реже, повторяя текущее меню. Состояние чата не меняется
+func SlowDown(c *gin.Context, msg *messages.Message) error {
+	chatState, err := getState(c, msg)
+	if err != nil {
+		return nil
+	}
+
+	_, err = (&Context{Gin: c, Message: msg, Chat: &chatState}).Reply(BOT_PHRASE_SLOW_DOWN)
+
+	return err
+}
+
+// profanityMiddleware не пропускает сообщения со словами из списка profanity.words
+func profanityMiddleware(next Handler) Handler {
+	return func(ctx *Context) (database.ChatState, error) {
+		if ctx.Message.MessageType != messages.MESSAGE_TEXT {
+			return next(ctx)
+		}
+
+		words := ctx.Config().Profanity.Words
+		if len(words) == 0 {
+			return next(ctx)
+		}
+
+		tokens := strings.FieldsFunc(strings.ToLower(ctx.Message.Text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, token := range tokens {
+			for _, word := range words {
+				if token == strings.ToLower(word) {
+					return ctx.Reply(BOT_PHRASE_PROFANITY)
+				}
+			}
+		}
+
+		return next(ctx)
+	}
+}
@@ -0,0 +1,213 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"connect-companion/bot/messages"
+	"connect-companion/bot/schedule"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	PENDING_CHECK_INTERVAL = time.Minute
+
+	// Передачу оставленных сообщений выполняет фоновая задача, а не ответ на push
+	ACTOR_PENDING_DELIVERY = "bot:pending_delivery"
+)
+
+var (
+	weekdayNames = [...]string{"воскресенье", "понедельник", "вторник", "среду", "четверг", "пятницу", "субботу"}
+)
+
+func isLineOpen(lineId uuid.UUID) bool {
+	cal := schedule.ForLine(lineId)
+
+	return cal == nil || cal.IsOpen(time.Now())
+}
+
+func offerLeaveMessage(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	return enter(c, msg, chatState, database.STATE_OFF_HOURS)
+}
+
+// showOffHours предлагает оставить сообщение. Если линия уже открылась, пока чат
+// стоял в этом состоянии, или у нее больше нет расписания - сразу переводит на специалиста
+func showOffHours(c *gin.Context, msg *messages.Message, chatState *database.Chat, text string) (database.ChatState, error) {
+	if isLineOpen(msg.LineId) {
+		return reroute(c, msg, chatState)
+	}
+
+	return showPrompt(c, msg, chatState, states[database.STATE_OFF_HOURS].variant(chatState), text)
+}
+
+func offHoursPhrase(msg *messages.Message) string {
+	now := time.Now()
+
+	next, ok := schedule.ForLine(msg.LineId).NextOpen(now)
+	if !ok {
+		return BOT_PHRASE_OFF_HOURS_UNKNOWN
+	}
+
+	return fmt.Sprintf(BOT_PHRASE_OFF_HOURS, humanizeTime(now.In(next.Location()), next))
+}
+
+// humanizeTime возвращает "сегодня в 09:00", "завтра в 09:00" или "в понедельник, 05.01 в 09:00"
+func humanizeTime(now, t time.Time) string {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	switch {
+	case day.Equal(today):
+		return "сегодня в " + t.Format("15:04")
+	case day.Equal(today.AddDate(0, 0, 1)):
+		return "завтра в " + t.Format("15:04")
+	default:
+		return "в " + weekdayNames[t.Weekday()] + ", " + t.Format("02.01 в 15:04")
+	}
+}
+
+// leaveMessage сохраняет сообщение до открытия линии и закрывает обращение
+func leaveMessage(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	if strings.TrimSpace(msg.Text) == "" {
+		return show(c, msg, chatState, states[database.STATE_LEAVE_MESSAGE], "")
+	}
+
+	data, err := json.Marshal(database.PendingMessage{
+		LineId: msg.LineId,
+		UserId: msg.UserId,
+		Topic:  chatState.Topic,
+		Text:   msg.Text,
+		LeftAt: time.Now(),
+	})
+	if err != nil {
+		return database.STATE_GREETINGS, err
+	}
+
+	if err = db.RPush(database.PREFIX_PENDING+msg.LineId.String(), data).Err(); err != nil {
+		logger.Warning("Error while save pending message", err)
+
+		return show(c, msg, chatState, states[database.STATE_LEAVE_MESSAGE], BOT_PHRASE_MESSAGE_NOT_LEFT)
+	}
+
+	return msg.CloseTreatment(c, BOT_PHRASE_MESSAGE_LEFT, database.STATE_GREETINGS)
+}
+
+// StartPendingDelivery периодически передает специалистам сообщения,
+// оставленные в нерабочее время, как только линия открывается
+func StartPendingDelivery(ctx context.Context, cnf *config.Conf, db redis.UniversalClient) {
+	c := backgroundContext(cnf, db)
+
+	go func() {
+		ticker := time.NewTicker(PENDING_CHECK_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !track() {
+					return
+				}
+				for _, lineId := range cnf.Line {
+					if isLineOpen(lineId) {
+						deliverPending(c, db, lineId)
+					}
+				}
+				untrack()
+			}
+		}
+	}()
+}
+
+func deliverPending(c *gin.Context, db redis.UniversalClient, lineId uuid.UUID) {
+	key := database.PREFIX_PENDING + lineId.String()
+
+	for {
+		data, err := db.LPop(key).Bytes()
+		if err == redis.Nil {
+			return
+		} else if err != nil {
+			logger.Warning("Error while reading pending messages", err)
+			return
+		}
+
+		var pending database.PendingMessage
+		if err = json.Unmarshal(data, &pending); err != nil {
+			logger.Warning("Error while decoding pending message", err)
+			continue
+		}
+
+		msg := &messages.Message{LineId: pending.LineId, UserId: pending.UserId, Actor: ACTOR_PENDING_DELIVERY}
+
+		logger.Info("Deliver pending message from", pending.UserId.String())
+
+		if _, err = appoint(c, msg, pending.Topic); err != nil {
+			db.LPush(key, data)
+			return
+		}
+
+		_, _ = msg.Send(c, fmt.Sprintf(BOT_PHRASE_PENDING_DELIVERED, pending.Text), database.STATE_GREETINGS, nil)
+	}
+}
+
+// backgroundContext нужен для отправки сообщений вне обработки входящего запроса
+func backgroundContext(cnf *config.Conf, db redis.UniversalClient) *gin.Context {
+	c := &gin.Context{}
+	c.Set("cnf", cnf)
+	c.Set("db", db)
+
+	return c
+}
+
+// PendingOf возвращает недоставленные сообщения пользователя, оставленные в нерабочее время
+func PendingOf(db redis.UniversalClient, userId uuid.UUID) ([]database.PendingMessage, error) {
+	return userPending(db, userId, false)
+}
+
+// ForgetPending удаляет недоставленные сообщения пользователя. Возвращает их число
+func ForgetPending(db redis.UniversalClient, userId uuid.UUID) (int, error) {
+	list, err := userPending(db, userId, true)
+
+	return len(list), err
+}
+
+func userPending(db redis.UniversalClient, userId uuid.UUID, remove bool) ([]database.PendingMessage, error) {
+	var list []database.PendingMessage
+
+	err := database.ScanKeys(db, database.PREFIX_PENDING+"*", func(key string) error {
+		items, err := db.LRange(key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			var pending database.PendingMessage
+			if err := json.Unmarshal([]byte(item), &pending); err != nil || pending.UserId != userId {
+				continue
+			}
+
+			if remove {
+				if err = db.LRem(key, 0, item).Err(); err != nil {
+					return err
+				}
+			}
+			list = append(list, pending)
+		}
+
+		return nil
+	})
+
+	return list, err
+}
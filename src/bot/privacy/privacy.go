@@ -0,0 +1,279 @@
+package privacy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"connect-companion/bot"
+	"connect-companion/bot/audit"
+	"connect-companion/bot/events"
+	"connect-companion/bot/flood"
+	"connect-companion/bot/survey"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	DATA_CHATS    = "chats"
+	DATA_SURVEY   = "survey"
+	DATA_PENDING  = "pending"
+	DATA_WEBHOOKS = "webhooks"
+	DATA_UPLOADS  = "uploads"
+	DATA_AUDIT    = "audit"
+
+	README = `Данные, которые бот хранит о пользователе.
+
+data.json:
+  chats    - состояние диалога на каждой линии: шаг, история, ответы форм (vars), варианты экспериментов
+  survey   - оценки и комментарии после закрытия обращений
+  pending  - сообщения, оставленные в нерабочее время и еще не переданные специалисту
+  webhooks - недоставленные уведомления внешним системам
+  flood    - временная блокировка и черный список
+  uploads  - сведения о присланных файлах, сами файлы - в каталоге uploads/
+  audit    - записи журнала аудита о действиях бота и администраторов с обращениями пользователя
+
+Переписку бот не хранит: история сообщений находится в 1С-Коннект.
+
+Журнал аудита при удалении данных не очищается: он подтверждает, кто и когда действовал,
+в том числе само удаление. В записях нет текстов сообщений, только идентификаторы, действие
+и результат. Старые записи вытесняются по audit.max_len.
+`
+)
+
+type (
+	// Data - все, что бот хранит о пользователе
+	Data struct {
+		UserId     uuid.UUID                 `json:"user_id" format:"uuid"`
+		ExportedAt time.Time                 `json:"exported_at"`
+		Chats      []Chat                    `json:"chats"`
+		Survey     []database.SurveyResult   `json:"survey"`
+		Pending    []database.PendingMessage `json:"pending"`
+		Webhooks   []events.DeadLetter       `json:"webhooks"`
+		Flood      Flood                     `json:"flood"`
+		Uploads    []database.Upload         `json:"uploads"`
+		Audit      []audit.Entry             `json:"audit"`
+	}
+
+	// Chat - состояние диалога на линии. Запись, которую не удалось прочитать, выгружается как есть
+	Chat struct {
+		LineId string          `json:"line_id"`
+		State  *database.Chat  `json:"state,omitempty"`
+		Raw    json.RawMessage `json:"raw,omitempty"`
+	}
+
+	Flood struct {
+		Blocked    bool       `json:"blocked"`
+		MutedUntil *time.Time `json:"muted_until,omitempty"`
+	}
+
+	// Erasure - сколько записей каждого вида удалено
+	Erasure struct {
+		UserId  uuid.UUID      `json:"user_id" format:"uuid"`
+		Deleted map[string]int `json:"deleted"`
+		// Черный список и блокировка за флуд - меры против злоупотреблений, а не данные
+		// пользователя, поэтому удаление их не снимает. Снять блокировку можно отдельно в /admin/flood/
+		Blocked bool `json:"blocked,omitempty"`
+	}
+)
+
+func chatsPattern(userId uuid.UUID) string {
+	return database.PREFIX_STATE + userId.String() + ":*"
+}
+
+// Collect собирает данные пользователя со всех линий
+func Collect(db redis.UniversalClient, cnf *config.Conf, userId uuid.UUID) (*Data, error) {
+	data := &Data{UserId: userId, ExportedAt: time.Now()}
+
+	err := database.ScanKeys(db, chatsPattern(userId), func(key string) error {
+		raw, err := db.Get(key).Bytes()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		chat := Chat{LineId: strings.TrimPrefix(key, database.PREFIX_STATE+userId.String()+":")}
+		if state, _, err := database.DecodeChat(raw); err == nil {
+			chat.State = &state
+		} else {
+			chat.Raw = raw
+		}
+		data.Chats = append(data.Chats, chat)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if data.Survey, err = survey.ForUser(db, userId); err != nil {
+		return nil, err
+	}
+	if data.Pending, err = bot.PendingOf(db, userId); err != nil {
+		return nil, err
+	}
+	if data.Webhooks, err = events.DeadLettersOf(db, userId); err != nil {
+		return nil, err
+	}
+
+	data.Flood.Blocked = flood.IsBlocked(db, userId)
+	mute, err := flood.MuteOf(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	if mute != nil {
+		data.Flood.MutedUntil = &mute.Until
+	}
+
+	if data.Uploads, err = bot.UploadsOf(cnf, userId); err != nil {
+		return nil, err
+	}
+	if data.Audit, err = audit.ForUser(db, userId); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Export пишет zip-архив с собранными Collect данными и присланными пользователем файлами
+// и отмечает выгрузку в журнале аудита от имени actor
+func Export(db redis.UniversalClient, cnf *config.Conf, data *Data, actor string, w io.Writer) error {
+	err := writeArchive(cnf, data, w)
+
+	entry := audit.Entry{Actor: actor, Action: audit.ACTION_PRIVACY_EXPORT, UserId: &data.UserId, Result: audit.RESULT_OK}
+	entry.Details = map[string]interface{}{
+		DATA_CHATS:    len(data.Chats),
+		DATA_SURVEY:   len(data.Survey),
+		DATA_PENDING:  len(data.Pending),
+		DATA_WEBHOOKS: len(data.Webhooks),
+		DATA_UPLOADS:  len(data.Uploads),
+		DATA_AUDIT:    len(data.Audit),
+	}
+	if err != nil {
+		entry.Result, entry.Error = audit.RESULT_ERROR, err.Error()
+	}
+	if auditErr := audit.Record(db, entry); auditErr != nil {
+		logger.Warning("Error while record audit", auditErr)
+	}
+
+	return err
+}
+
+func writeArchive(cnf *config.Conf, data *Data, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	readme, err := archive.Create("README.txt")
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(readme, README); err != nil {
+		return err
+	}
+
+	file, err := archive.Create("data.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(data); err != nil {
+		return err
+	}
+
+	for _, upload := range data.Uploads {
+		if err = copyUpload(archive, filepath.Join(bot.UploadsDir(cnf, data.UserId), upload.StoredAs), upload.StoredAs); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func copyUpload(archive *zip.Writer, path string, name string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dst, err := archive.Create("uploads/" + name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, f)
+
+	return err
+}
+
+// Erase удаляет все данные пользователя и записывает в журнал аудита, кто и что удалил.
+// При ошибке удаление можно повторить: уже удаленное просто не найдется
+func Erase(db redis.UniversalClient, cnf *config.Conf, userId uuid.UUID, actor string) (*Erasure, error) {
+	erasure := &Erasure{UserId: userId, Deleted: map[string]int{DATA_CHATS: 0}}
+
+	err := erase(db, cnf, erasure)
+
+	entry := audit.Entry{Actor: actor, Action: audit.ACTION_PRIVACY_ERASE, UserId: &userId, Result: audit.RESULT_OK}
+	details := map[string]interface{}{}
+	for kind, n := range erasure.Deleted {
+		details[kind] = n
+	}
+	if erasure.Blocked {
+		details["still_blocked"] = true
+	}
+	entry.Details = details
+	if err != nil {
+		entry.Result, entry.Error = audit.RESULT_ERROR, err.Error()
+	}
+	if auditErr := audit.Record(db, entry); auditErr != nil {
+		logger.Warning("Error while record audit", auditErr)
+	}
+
+	return erasure, err
+}
+
+func erase(db redis.UniversalClient, cnf *config.Conf, erasure *Erasure) error {
+	userId := erasure.UserId
+
+	err := database.ScanKeys(db, chatsPattern(userId), func(key string) error {
+		n, err := db.Del(key).Result()
+		erasure.Deleted[DATA_CHATS] += int(n)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	steps := []struct {
+		kind   string
+		forget func() (int, error)
+	}{
+		{DATA_SURVEY, func() (int, error) { return survey.Forget(db, userId) }},
+		{DATA_PENDING, func() (int, error) { return bot.ForgetPending(db, userId) }},
+		{DATA_WEBHOOKS, func() (int, error) { return events.ForgetDeadLetters(db, userId) }},
+		{DATA_UPLOADS, func() (int, error) { return bot.ForgetUploads(cnf, userId) }},
+	}
+	for _, step := range steps {
+		n, err := step.forget()
+		erasure.Deleted[step.kind] = n
+		if err != nil {
+			return err
+		}
+	}
+
+	erasure.Blocked = flood.IsBlocked(db, userId)
+
+	return nil
+}
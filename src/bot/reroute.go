@@ -0,0 +1,47 @@
+package bot
+
+import (
+	"time"
+
+	"connect-companion/bot/experiments"
+	"connect-companion/bot/messages"
+	"connect-companion/bot/routing"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+)
+
+// reroute переводит пользователя на специалиста, а в нерабочее время
+// предлагает оставить сообщение
+func reroute(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+	countOutcome(c, chatState, experiments.METRIC_REROUTED)
+
+	if !isLineOpen(msg.LineId) {
+		return offerLeaveMessage(c, msg, chatState)
+	}
+
+	_, _ = msg.Send(c, BOT_PHRASE_RETOUTING, database.STATE_GREETINGS, nil)
+
+	messages.Pause(500 * time.Millisecond)
+
+	return appoint(c, msg, chatState.Topic)
+}
+
+// appoint назначает обращение на специалистов по правилам маршрутизации,
+// а если никто из них не доступен - в общую очередь линии
+func appoint(c *gin.Context, msg *messages.Message, topic string) (database.ChatState, error) {
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	for _, specId := range routing.Candidates(db, msg.LineId, msg.UserId, topic) {
+		_, err := msg.AppointSpec(specId, database.STATE_GREETINGS)
+		if err == nil {
+			logger.Info("Treatment of", msg.UserId.String(), "appointed to spec", specId.String())
+
+			return database.STATE_GREETINGS, nil
+		}
+	}
+
+	return msg.RerouteTreatment(c, "", database.STATE_GREETINGS)
+}
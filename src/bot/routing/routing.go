@@ -0,0 +1,141 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"connect-companion/bot/schedule"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	STRATEGY_ROUND_ROBIN = "round_robin"
+	STRATEGY_ORDERED     = "ordered"
+)
+
+type (
+	rule struct {
+		config.RoutingRule
+
+		key   string
+		hours *schedule.Calendar
+	}
+)
+
+var (
+	rules []rule
+)
+
+// Configure проверяет правила маршрутизации и готовит их календари
+func Configure(cnf *config.Conf) error {
+	result := make([]rule, 0, len(cnf.Routing.Rules))
+
+	for i, r := range cnf.Routing.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+
+		switch r.Strategy {
+		case "":
+			r.Strategy = STRATEGY_ROUND_ROBIN
+		case STRATEGY_ROUND_ROBIN, STRATEGY_ORDERED:
+		default:
+			return fmt.Errorf("routing rule %s: unknown strategy %q", name, r.Strategy)
+		}
+
+		if len(r.Specs) == 0 {
+			return fmt.Errorf("routing rule %s: no specs", name)
+		}
+
+		compiled := rule{RoutingRule: r, key: database.PREFIX_ROUTING + name}
+		if r.Hours != nil {
+			cal, err := schedule.New(r.Hours)
+			if err != nil {
+				return fmt.Errorf("routing rule %s: %w", name, err)
+			}
+			compiled.hours = cal
+		}
+
+		result = append(result, compiled)
+	}
+
+	rules = result
+
+	return nil
+}
+
+// Candidates возвращает специалистов первого подходящего правила в порядке,
+// в котором их стоит пробовать. Пустой список - переводим в общую очередь.
+func Candidates(db redis.UniversalClient, lineId uuid.UUID, userId uuid.UUID, topic string) []uuid.UUID {
+	now := time.Now()
+
+	for i := range rules {
+		r := &rules[i]
+		if !r.match(lineId, userId, topic, now) {
+			continue
+		}
+
+		logger.Debug("Routing rule matched", r.key)
+
+		specs := make([]uuid.UUID, len(r.Specs))
+		copy(specs, r.Specs)
+
+		if r.Strategy == STRATEGY_ROUND_ROBIN && len(specs) > 1 {
+			n, err := db.Incr(r.key).Result()
+			if err != nil {
+				logger.Warning("Error while read round robin counter", err)
+			}
+
+			offset := int(n % int64(len(specs)))
+			specs = append(specs[offset:], specs[:offset]...)
+		}
+
+		return specs
+	}
+
+	return nil
+}
+
+func (r *rule) match(lineId uuid.UUID, userId uuid.UUID, topic string, now time.Time) bool {
+	if len(r.Topics) > 0 && !containsString(r.Topics, topic) {
+		return false
+	}
+	if len(r.Lines) > 0 && !containsUUID(r.Lines, lineId) {
+		return false
+	}
+	if len(r.Users) > 0 && !containsUUID(r.Users, userId) {
+		return false
+	}
+	if r.hours != nil && !r.hours.IsOpen(now) {
+		return false
+	}
+
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for i := range list {
+		if strings.EqualFold(list[i], s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsUUID(list []uuid.UUID, id uuid.UUID) bool {
+	for i := range list {
+		if list[i] == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,267 @@
+package schedule
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"connect-companion/config"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DATE_LAYOUT = "2006-01-02"
+
+	// Сколько дней вперед ищем ближайшее рабочее время
+	LOOKAHEAD_DAYS = 366
+)
+
+type (
+	interval struct {
+		From int // минуты от начала суток
+		To   int
+	}
+
+	// Calendar - рабочее время линии с учетом праздников и переносов
+	Calendar struct {
+		loc  *time.Location
+		week [7][]interval
+		days map[string][]interval
+	}
+)
+
+var (
+	weekdays = map[string]time.Weekday{
+		"sun": time.Sunday,
+		"mon": time.Monday,
+		"tue": time.Tuesday,
+		"wed": time.Wednesday,
+		"thu": time.Thursday,
+		"fri": time.Friday,
+		"sat": time.Saturday,
+	}
+
+	calendars = map[uuid.UUID]*Calendar{}
+)
+
+// Configure строит календари для всех линий. Линия без собственных настроек
+// использует общие business_hours, без них - считается работающей всегда.
+func Configure(cnf *config.Conf) error {
+	result := map[uuid.UUID]*Calendar{}
+
+	var common *Calendar
+	if cnf.BusinessHours != nil {
+		cal, err := New(cnf.BusinessHours)
+		if err != nil {
+			return fmt.Errorf("business_hours: %w", err)
+		}
+		common = cal
+	}
+
+	for _, lineId := range cnf.Line {
+		result[lineId] = common
+	}
+
+	for lineId, lineConf := range cnf.Lines {
+		if lineConf.Hours == nil {
+			continue
+		}
+
+		cal, err := New(lineConf.Hours)
+		if err != nil {
+			return fmt.Errorf("lines.%s.business_hours: %w", lineId, err)
+		}
+		result[lineId] = cal
+	}
+
+	calendars = result
+
+	return nil
+}
+
+// ForLine возвращает календарь линии или nil, если линия работает круглосуточно
+func ForLine(lineId uuid.UUID) *Calendar {
+	return calendars[lineId]
+}
+
+func New(h *config.BusinessHours) (*Calendar, error) {
+	cal := &Calendar{
+		loc:  time.Local,
+		days: map[string][]interval{},
+	}
+
+	if h.TimeZone != "" {
+		loc, err := time.LoadLocation(h.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		cal.loc = loc
+	}
+
+	for day, hours := range h.Week {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown week day %q", day)
+		}
+
+		intervals, err := parseIntervals(hours)
+		if err != nil {
+			return nil, fmt.Errorf("week.%s: %w", day, err)
+		}
+		cal.week[weekday] = intervals
+	}
+
+	if h.CalendarFile != "" {
+		if err := cal.loadFile(h.CalendarFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Праздники из конфигурации важнее производственного календаря
+	for _, date := range h.Holidays {
+		if _, err := time.Parse(DATE_LAYOUT, date); err != nil {
+			return nil, fmt.Errorf("holidays: %w", err)
+		}
+		cal.days[date] = nil
+	}
+
+	return cal, nil
+}
+
+// loadFile читает производственный календарь: "YYYY-MM-DD" - нерабочий день,
+// "YYYY-MM-DD 09:00-17:00" - рабочий день с указанными часами (переносы, сокращенные дни).
+func (cal *Calendar) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if _, err := time.Parse(DATE_LAYOUT, fields[0]); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+
+		intervals, err := parseIntervals(strings.Join(fields[1:], ","))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		cal.days[fields[0]] = intervals
+	}
+
+	return scanner.Err()
+}
+
+// IsOpen сообщает, работают ли специалисты в момент t
+func (cal *Calendar) IsOpen(t time.Time) bool {
+	t = t.In(cal.loc)
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, i := range cal.intervals(t) {
+		if minute >= i.From && minute < i.To {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextOpen возвращает ближайший момент начала рабочего времени после t.
+// У линии без расписания такого момента нет
+func (cal *Calendar) NextOpen(t time.Time) (time.Time, bool) {
+	if cal == nil {
+		return time.Time{}, false
+	}
+
+	t = t.In(cal.loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, cal.loc)
+
+	for i := 0; i < LOOKAHEAD_DAYS; i++ {
+		for _, interval := range cal.intervals(day) {
+			if i == 0 && interval.From <= minute {
+				continue
+			}
+
+			return day.Add(time.Duration(interval.From) * time.Minute), true
+		}
+
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return time.Time{}, false
+}
+
+// Location возвращает часовой пояс календаря. У линии без расписания - часовой пояс сервера
+func (cal *Calendar) Location() *time.Location {
+	if cal == nil {
+		return time.Local
+	}
+
+	return cal.loc
+}
+
+func (cal *Calendar) intervals(t time.Time) []interval {
+	if intervals, ok := cal.days[t.Format(DATE_LAYOUT)]; ok {
+		return intervals
+	}
+
+	return cal.week[t.Weekday()]
+}
+
+// parseIntervals разбирает строку вида "09:00-13:00,14:00-18:00"
+func parseIntervals(s string) ([]interval, error) {
+	var result []interval
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.Split(part, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("bad interval %q", part)
+		}
+
+		from, err := parseClock(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if to <= from {
+			return nil, fmt.Errorf("bad interval %q", part)
+		}
+
+		result = append(result, interval{From: from, To: to})
+	}
+
+	return result, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		// 24:00 - конец суток
+		if strings.TrimSpace(s) == "24:00" {
+			return 24 * 60, nil
+		}
+
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,66 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"connect-companion/config"
+)
+
+func TestNextOpen(t *testing.T) {
+	cal, err := New(&config.BusinessHours{
+		TimeZone: "Europe/Moscow",
+		Week: map[string]string{
+			"mon": "09:00-13:00,14:00-18:00",
+			"tue": "09:00-18:00",
+			"fri": "10:00-16:00",
+		},
+		Holidays: []string{"2026-07-07"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := cal.Location()
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.July, day, hour, minute, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		// 2026-07-06 - понедельник
+		{"before opening", at(6, 8, 0), at(6, 9, 0)},
+		{"lunch break", at(6, 13, 30), at(6, 14, 0)},
+		{"open now - next interval", at(6, 10, 0), at(6, 14, 0)},
+		{"after closing, holiday next", at(6, 18, 0), at(10, 10, 0)},
+		{"weekend", at(11, 12, 0), at(13, 9, 0)},
+	}
+
+	for _, test := range tests {
+		got, ok := cal.NextOpen(test.now)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("%s: got %v, %v, want %v", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestNextOpenWithoutCalendar(t *testing.T) {
+	var cal *Calendar
+
+	if _, ok := cal.NextOpen(time.Now()); ok {
+		t.Error("line without calendar has no next opening")
+	}
+}
+
+func TestNextOpenNeverOpen(t *testing.T) {
+	cal, err := New(&config.BusinessHours{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cal.NextOpen(time.Now()); ok {
+		t.Error("calendar without hours has no next opening")
+	}
+}
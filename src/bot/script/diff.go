@@ -0,0 +1,45 @@
+package script
+
+import (
+	"strings"
+)
+
+// diffLines выводит построчную разницу: "- " - ожидалось, "+ " - получено, "  " - совпало
+func diffLines(expected []string, actual []string) string {
+	// lcs[i][j] - длина общей подпоследовательности expected[i:] и actual[j:]
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(actual)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(actual) - 1; j >= 0; j-- {
+			if expected[i] == actual[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case i < len(expected) && j < len(actual) && expected[i] == actual[j]:
+			out.WriteString("  " + expected[i] + "\n")
+			i++
+			j++
+		case j >= len(actual) || (i < len(expected) && lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + expected[i] + "\n")
+			i++
+		default:
+			out.WriteString("+ " + actual[j] + "\n")
+			j++
+		}
+	}
+
+	return out.String()
+}
@@ -0,0 +1,84 @@
+package script
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"connect-companion/bot"
+	"connect-companion/bot/events"
+	"connect-companion/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+// Бот закрывает обращение, и Connect присылает push о закрытии с автором-ботом:
+// подписчики должны получить одно событие closed
+func TestCloseByBotEmitsOneEvent(t *testing.T) {
+	var mu sync.Mutex
+	var received []events.Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event events.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mini.Close()
+	db := redis.NewClient(&redis.Options{Addr: mini.Addr()})
+
+	specId := uuid.New()
+	cnf := &config.Conf{FilesDir: "../../scripts/files", SpecID: &specId}
+	cnf.Webhooks = []config.Webhook{{Url: srv.URL, Events: []string{events.CLOSED}}}
+	if err = bot.Configure(cnf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events.Start(ctx, cnf, db)
+	defer events.Start(context.Background(), &config.Conf{}, db)
+	defer cancel()
+
+	runner, err := NewRunner(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Close()
+
+	session, err := runner.NewSession(&Script{State: "main_menu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	for _, step := range []Step{{Send: SEND_TEXT, Text: "Закрыть обращение"}, {Send: SEND_CLOSE, Author: AUTHOR_BOT}} {
+		if _, err = session.Send(&step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("got %d closed events, want 1: %+v", len(received), received)
+	}
+	if by := received[0].Data["by"]; by != "bot" {
+		t.Errorf("got by %v, want bot", by)
+	}
+}
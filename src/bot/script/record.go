@@ -0,0 +1,184 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+
+	"connect-companion/bot/client"
+	"connect-companion/bot/requests"
+)
+
+type (
+	// Recorder записывает вызовы API Connect вместо их отправки
+	Recorder struct {
+		mu      sync.Mutex
+		replies []Reply
+		fail    map[string]bool
+	}
+)
+
+// Invoke - client.Invoker, который превращает вызов в Reply
+func (r *Recorder) Invoke(call *client.Call) ([]byte, error) {
+	r.mu.Lock()
+	failing := r.fail[call.Url]
+	r.mu.Unlock()
+
+	reply, record, err := decodeCall(call)
+	if err != nil {
+		return nil, err
+	}
+
+	if failing {
+		call.Status = http.StatusInternalServerError
+
+		return nil, &client.HttpError{Url: call.Url, Code: http.StatusInternalServerError, Message: "failed by script"}
+	}
+
+	if record {
+		r.mu.Lock()
+		r.replies = append(r.replies, reply)
+		r.mu.Unlock()
+	}
+	call.Status = http.StatusOK
+
+	return []byte("{}"), nil
+}
+
+// Download - client.Downloader, который читает файл сценария с диска
+func (r *Recorder) Download(fileUrl string, w io.Writer, limit int64) (int64, error) {
+	file, err := os.Open(fileUrl)
+	if err != nil {
+		return 0, &client.HttpError{Url: fileUrl, Code: http.StatusNotFound, Message: err.Error()}
+	}
+	defer file.Close()
+
+	written, err := io.Copy(w, io.LimitReader(file, limit+1))
+	if err != nil {
+		return written, err
+	}
+	if written > limit {
+		return written, client.ErrFileTooLarge
+	}
+
+	return written, nil
+}
+
+// take возвращает записанное с прошлого вызова и задает методы, которые будут падать
+func (r *Recorder) take(fail []string) []Reply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	replies := r.replies
+	r.replies = nil
+
+	r.fail = map[string]bool{}
+	for _, url := range fail {
+		r.fail[url] = true
+	}
+
+	return replies
+}
+
+func decodeCall(call *client.Call) (reply Reply, record bool, err error) {
+	switch call.Url {
+	case "/line/send/message/":
+		var req requests.MessageRequest
+		if err = json.NewDecoder(call.Body).Decode(&req); err != nil {
+			return reply, false, err
+		}
+
+		return Reply{Text: req.Text, Keyboard: keyTexts(req.Keyboard)}, true, nil
+	case "/line/send/file/", "/line/send/image/":
+		req, err := decodeFileForm(call)
+		if err != nil {
+			return reply, false, err
+		}
+
+		reply = Reply{File: req.FileName, Keyboard: keyTexts(req.Keyboard)}
+		if req.Comment != nil {
+			reply.Text = *req.Comment
+		}
+
+		return reply, true, nil
+	case "/line/drop/keyboard/":
+		return Reply{Action: ACTION_DROP_KEYBOARD}, true, nil
+	case "/line/appoint/start/":
+		return Reply{Action: ACTION_REROUTE}, true, nil
+	case "/line/appoint/spec/":
+		var req requests.TreatmentWithSpecRequest
+		if err = json.NewDecoder(call.Body).Decode(&req); err != nil {
+			return reply, false, err
+		}
+
+		return Reply{Action: ACTION_APPOINT, Spec: req.SpecId.String()}, true, nil
+	case "/line/drop/treatment/":
+		return Reply{Action: ACTION_CLOSE}, true, nil
+	case "/hook/":
+		return reply, false, nil
+	}
+
+	if call.Method == "DELETE" {
+		return reply, false, nil
+	}
+
+	return Reply{Action: call.Method + " " + call.Url}, true, nil
+}
+
+// decodeFileForm читает метаданные из multipart-запроса отправки файла, сам файл пропускается
+func decodeFileForm(call *client.Call) (*requests.FileRequest, error) {
+	_, params, err := mime.ParseMediaType(call.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	var req *requests.FileRequest
+
+	reader := multipart.NewReader(call.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "meta" {
+			req = &requests.FileRequest{}
+			if err = json.NewDecoder(part).Decode(req); err != nil {
+				return nil, err
+			}
+		} else if _, err = io.Copy(ioutil.Discard, part); err != nil {
+			return nil, err
+		}
+	}
+
+	if req == nil {
+		return nil, fmt.Errorf("no meta in file request")
+	}
+
+	return req, nil
+}
+
+func keyTexts(keyboard *[][]requests.KeyboardKey) [][]string {
+	if keyboard == nil {
+		return nil
+	}
+
+	rows := make([][]string, 0, len(*keyboard))
+	for _, row := range *keyboard {
+		texts := make([]string, 0, len(row))
+		for _, key := range row {
+			texts = append(texts, key.Text)
+		}
+		rows = append(rows, texts)
+	}
+
+	return rows
+}
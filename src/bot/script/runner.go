@@ -0,0 +1,401 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"connect-companion/bot"
+	"connect-companion/bot/client"
+	"connect-companion/bot/flood"
+	"connect-companion/bot/messages"
+	"connect-companion/config"
+	"connect-companion/database"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+type (
+	// Runner прогоняет сценарии через настоящую обработку сообщений с Redis в памяти
+	// и записью вызовов API вместо отправки. Одновременно может работать один Runner
+	Runner struct {
+		cnf      *config.Conf
+		mini     *miniredis.Miniredis
+		db       redis.UniversalClient
+		recorder *Recorder
+		uploads  string
+		restore  []func()
+	}
+
+	// Result - итог прогона сценария. Steps - что бот сделал на каждом шаге
+	Result struct {
+		Script   *Script
+		Steps    []StepResult
+		Failures []Failure
+	}
+
+	StepResult struct {
+		Replies []Reply
+		State   string
+		Vars    map[string]string
+	}
+
+	Failure struct {
+		Step int
+		Diff string
+	}
+
+	// Session - разговор одного пользователя, шаги которого отправляются по одному
+	Session struct {
+		runner *Runner
+		script *Script
+		gin    *gin.Context
+		done   func()
+	}
+)
+
+// NewRunner готовит окружение для сценариев. Настройки диалогов (bot.Configure)
+// должны быть применены заранее. Close возвращает все как было
+func NewRunner(cnf *config.Conf) (*Runner, error) {
+	mini := miniredis.NewMiniRedis()
+	if err := mini.StartAddr("127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+
+	uploads, err := ioutil.TempDir("", "connect-companion-uploads")
+	if err != nil {
+		mini.Close()
+		return nil, err
+	}
+
+	runCnf := *cnf
+	runCnf.Uploads.Dir = uploads
+
+	r := &Runner{
+		cnf:      &runCnf,
+		mini:     mini,
+		recorder: &Recorder{},
+		uploads:  uploads,
+	}
+
+	// Соединения с Redis идут через pipe, без сети
+	r.db = redis.NewClient(&redis.Options{
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			mini.Server().ServeConn(peer)
+
+			return conn, nil
+		},
+	})
+
+	pause := messages.Pause
+	messages.Pause = func(time.Duration) {}
+
+	r.restore = append(r.restore,
+		client.SetTransport(r.recorder.Invoke),
+		client.SetDownloader(r.recorder.Download),
+		func() { messages.Pause = pause },
+	)
+
+	return r, nil
+}
+
+func (r *Runner) Close() {
+	for i := len(r.restore) - 1; i >= 0; i-- {
+		r.restore[i]()
+	}
+
+	_ = r.db.Close()
+	r.mini.Close()
+	_ = os.RemoveAll(r.uploads)
+}
+
+// Run прогоняет сценарий с чистого хранилища
+func (r *Runner) Run(script *Script) (*Result, error) {
+	session, err := r.NewSession(script)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	result := &Result{Script: script}
+
+	for i := range script.Steps {
+		step := &script.Steps[i]
+
+		actual, err := session.Send(step)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		result.Steps = append(result.Steps, *actual)
+
+		if diff := compare(step, actual); diff != "" {
+			result.Failures = append(result.Failures, Failure{Step: i + 1, Diff: diff})
+		}
+	}
+
+	return result, nil
+}
+
+// NewSession очищает хранилище и готовит чат по заголовку сценария (state, vars, config).
+// Шаги сценария не выполняются
+func (r *Runner) NewSession(script *Script) (*Session, error) {
+	r.mini.FlushAll()
+	r.recorder.take(nil)
+
+	session := &Session{runner: r, script: script, done: func() {}}
+
+	cnf := r.cnf
+	if len(script.Config) > 0 {
+		var err error
+		if cnf, err = script.configure(r.cnf); err != nil {
+			return nil, err
+		}
+		if err = bot.Configure(cnf); err != nil {
+			return nil, err
+		}
+		session.done = func() { _ = bot.Configure(r.cnf) }
+	}
+
+	if script.State != "" || len(script.Vars) > 0 {
+		chat := database.Chat{Vars: script.Vars}
+		if script.State != "" {
+			state, err := parseState(script.State)
+			if err != nil {
+				session.Close()
+				return nil, err
+			}
+			chat.CurrentState = state
+		}
+		if err := r.saveChat(script, chat); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+
+	session.gin = &gin.Context{}
+	session.gin.Set("cnf", cnf)
+	session.gin.Set("db", r.db)
+
+	return session, nil
+}
+
+// Send обрабатывает сообщение шага и возвращает, что сделал бот
+func (s *Session) Send(step *Step) (*StepResult, error) {
+	s.runner.recorder.take(step.Fail)
+
+	msg, err := s.runner.message(s.script, step)
+	if err != nil {
+		return nil, err
+	}
+
+	switch bot.Admit(s.gin, msg) {
+	case flood.ALLOW:
+		_ = bot.Dispatch(s.gin, msg)
+	case flood.SLOW_DOWN:
+		_ = bot.SlowDown(s.gin, msg)
+	}
+
+	chat, err := s.Chat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &StepResult{
+		Replies: s.runner.recorder.take(nil),
+		State:   bot.StateName(chat.CurrentState),
+		Vars:    chat.Vars,
+	}, nil
+}
+
+// Chat возвращает сохраненное состояние чата
+func (s *Session) Chat() (database.Chat, error) {
+	return s.runner.loadChat(s.script)
+}
+
+// Close возвращает настройки, измененные секцией config сценария
+func (s *Session) Close() {
+	s.done()
+}
+
+func (r *Runner) message(script *Script, step *Step) (*messages.Message, error) {
+	msg := &messages.Message{
+		LineId:      script.line(),
+		UserId:      script.user(),
+		MessageID:   uuid.New(),
+		MessageType: messageTypes[step.Send],
+		MessageTime: time.Now().Format(time.RFC3339),
+		Text:        step.Text,
+	}
+	msg.Data.Redirect = step.Redirect
+
+	switch step.Author {
+	case "":
+	case AUTHOR_BOT:
+		if r.cnf.SpecID == nil {
+			return nil, fmt.Errorf("author %s: spec_id is not set", AUTHOR_BOT)
+		}
+		msg.MessageAuthor = r.cnf.SpecID
+	default:
+		author, err := uuid.Parse(step.Author)
+		if err != nil {
+			return nil, fmt.Errorf("author: %w", err)
+		}
+		msg.MessageAuthor = &author
+	}
+
+	if step.File != "" {
+		path := step.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(script.path), path)
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Data.FileName = filepath.Base(path)
+		msg.Data.FileSize = fi.Size()
+		msg.Data.FileUrl = path
+	}
+
+	return msg, nil
+}
+
+func (r *Runner) stateKey(script *Script) string {
+	return database.PREFIX_STATE + script.user().String() + ":" + script.line().String()
+}
+
+func (r *Runner) saveChat(script *Script, chat database.Chat) error {
+	data, err := database.EncodeChat(&chat)
+	if err != nil {
+		return err
+	}
+
+	return r.db.Set(r.stateKey(script), data, 0).Err()
+}
+
+func (r *Runner) loadChat(script *Script) (database.Chat, error) {
+	var chat database.Chat
+
+	data, err := r.db.Get(r.stateKey(script)).Bytes()
+	if err == redis.Nil {
+		return chat, nil
+	} else if err != nil {
+		return chat, err
+	}
+
+	chat, _, err = database.DecodeChat(data)
+
+	return chat, err
+}
+
+// parseState принимает имя состояния или его номер
+func parseState(s string) (database.ChatState, error) {
+	if id, ok := bot.StateId(s); ok {
+		return id, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return database.STATE_DUMMY, fmt.Errorf("unknown state %q", s)
+	}
+
+	return database.ChatState(n), nil
+}
+
+// compare сверяет шаг с ожиданиями и возвращает различия в виде diff
+func compare(step *Step, actual *StepResult) string {
+	var out strings.Builder
+
+	if step.Expect != nil && !repliesMatch(step.Expect, actual.Replies) {
+		out.WriteString(diffLines(replyLines(step.Expect), replyLines(actual.Replies)))
+	}
+
+	if step.State != "" {
+		expected, err := parseState(step.State)
+		if err != nil || bot.StateName(expected) != actual.State {
+			fmt.Fprintf(&out, "- state: %s\n+ state: %s\n", step.State, actual.State)
+		}
+	}
+
+	for name, value := range step.Vars {
+		if actual.Vars[name] != value {
+			fmt.Fprintf(&out, "- vars.%s: %s\n+ vars.%s: %s\n", name, value, name, actual.Vars[name])
+		}
+	}
+
+	return out.String()
+}
+
+// repliesMatch сравнивает ответы. Клавиатура проверяется, только если указана в ожидании
+func repliesMatch(expected []Reply, actual []Reply) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	for i := range expected {
+		e, a := expected[i], actual[i]
+		if e.Keyboard == nil {
+			a.Keyboard = nil
+		}
+		if !reflect.DeepEqual(e, a) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func replyLines(replies []Reply) []string {
+	lines := make([]string, 0, len(replies))
+	for _, reply := range replies {
+		lines = append(lines, reply.String())
+	}
+
+	return lines
+}
+
+// Update записывает в сценарий фактические ответы и состояния
+func (result *Result) Update() error {
+	for i := range result.Script.Steps {
+		if i >= len(result.Steps) {
+			break
+		}
+
+		step := &result.Script.Steps[i]
+		step.Expect = result.Steps[i].Replies
+		if step.Expect == nil {
+			step.Expect = []Reply{}
+		}
+		step.State = result.Steps[i].State
+	}
+
+	return result.Script.Save()
+}
+
+// Report описывает расхождения для вывода в консоль
+func (result *Result) Report() string {
+	var out strings.Builder
+
+	for _, failure := range result.Failures {
+		step := &result.Script.Steps[failure.Step-1]
+		fmt.Fprintf(&out, "%s: step %d (%s):\n", result.Script.path, failure.Step, step.String())
+		for _, line := range strings.Split(strings.TrimRight(failure.Diff, "\n"), "\n") {
+			out.WriteString("    " + line + "\n")
+		}
+	}
+
+	return out.String()
+}
@@ -0,0 +1,252 @@
+package script
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"connect-companion/bot/messages"
+	"connect-companion/config"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SEND_TEXT          = "text"
+	SEND_FILE          = "file"
+	SEND_START         = "start"
+	SEND_START_NO_CALL = "start_no_treatment"
+	SEND_START_BY_USER = "start_by_user"
+	SEND_START_BY_SPEC = "start_by_spec"
+	SEND_CLOSE         = "close"
+	SEND_CLOSE_ACTIVE  = "close_active"
+	SEND_TO_BOT        = "to_bot"
+
+	// Автор push - сам бот (spec_id из настроек)
+	AUTHOR_BOT = "bot"
+
+	ACTION_DROP_KEYBOARD = "drop_keyboard"
+	ACTION_REROUTE       = "reroute"
+	ACTION_APPOINT       = "appoint"
+	ACTION_CLOSE         = "close"
+)
+
+var (
+	DefaultLine = uuid.MustParse("00000000-0000-0000-0000-00000000000a")
+	DefaultUser = uuid.MustParse("00000000-0000-0000-0000-00000000000b")
+
+	messageTypes = map[string]messages.MessageType{
+		SEND_TEXT:          messages.MESSAGE_TEXT,
+		SEND_FILE:          messages.MESSAGE_FILE,
+		SEND_START:         messages.MESSAGE_CALL_START_TREATMENT,
+		SEND_START_NO_CALL: messages.MESSAGE_CALL_START_NO_TREATMENT,
+		SEND_START_BY_USER: messages.MESSAGE_TREATMENT_START_BY_USER,
+		SEND_START_BY_SPEC: messages.MESSAGE_TREATMENT_START_BY_SPEC,
+		SEND_CLOSE:         messages.MESSAGE_TREATMENT_CLOSE,
+		SEND_CLOSE_ACTIVE:  messages.MESSAGE_TREATMENT_CLOSE_ACTIVE,
+		SEND_TO_BOT:        messages.MESSAGE_TREATMENT_TO_BOT,
+	}
+)
+
+type (
+	// Script - сценарий разговора: сообщения пользователя и ожидаемые ответы бота
+	//
+	//	name: Больничный
+	//	steps:
+	//	  - send: start
+	//	  - text: "4"
+	//	    expect:
+	//	      - text: Прикрепите, пожалуйста, скан или фото больничного листа.
+	//	        keyboard: [[Перевести на специалиста], [Назад, В главное меню]]
+	//	    state: wait_sick_leave
+	//	  - file: testdata/scan.pdf
+	//	    expect:
+	//	      - text: Спасибо, файл получен и передан в отдел кадров.
+	Script struct {
+		Name string     `yaml:"name"`
+		Line *uuid.UUID `yaml:"line,omitempty"`
+		User *uuid.UUID `yaml:"user,omitempty"`
+		// Состояние чата перед первым шагом, по умолчанию - новый чат
+		State string            `yaml:"state,omitempty"`
+		Vars  map[string]string `yaml:"vars,omitempty"`
+		// Секции настроек на время сценария. Заменяют одноименные секции целиком:
+		//
+		//	config:
+		//	  survey: {enabled: true, comment: true}
+		Config yaml.MapSlice `yaml:"config,omitempty"`
+		Steps  []Step        `yaml:"steps"`
+
+		path string
+	}
+
+	// Step - входящее сообщение и то, что бот должен сделать в ответ.
+	// Не указанные expect и state не проверяются, expect: [] - бот должен промолчать
+	Step struct {
+		Send string `yaml:"send,omitempty"`
+		Text string `yaml:"text,omitempty"`
+		// Файл от пользователя, путь относительно сценария
+		File     string `yaml:"file,omitempty"`
+		Redirect string `yaml:"redirect,omitempty"`
+		// Автор push, например закрывший обращение: bot или Id специалиста
+		Author string `yaml:"author,omitempty"`
+		// Методы API Connect, которые на этом шаге отвечают ошибкой
+		Fail []string `yaml:"fail,omitempty"`
+
+		Expect []Reply           `yaml:"expect"`
+		State  string            `yaml:"state,omitempty"`
+		Vars   map[string]string `yaml:"vars,omitempty"`
+	}
+
+	// Reply - сообщение, файл или действие бота с обращением
+	Reply struct {
+		Text     string     `yaml:"text,omitempty"`
+		File     string     `yaml:"file,omitempty"`
+		Action   string     `yaml:"action,omitempty"`
+		Spec     string     `yaml:"spec,omitempty"`
+		Keyboard [][]string `yaml:"keyboard,omitempty,flow"`
+	}
+)
+
+// Load читает сценарий из YAML
+func Load(path string) (*Script, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	script := &Script{path: path}
+	if err = yaml.UnmarshalStrict(data, script); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if script.Name == "" {
+		script.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	for i := range script.Steps {
+		step := &script.Steps[i]
+		if step.Send == "" {
+			step.Send = SEND_TEXT
+			if step.File != "" {
+				step.Send = SEND_FILE
+			}
+		}
+		if _, ok := messageTypes[step.Send]; !ok {
+			return nil, fmt.Errorf("%s: step %d: unknown message %q", path, i+1, step.Send)
+		}
+	}
+
+	return script, nil
+}
+
+// Save перезаписывает сценарий, например с ответами из прогона. Комментарии не сохраняются
+func (script *Script) Save() error {
+	data, err := yaml.Marshal(script)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(script.path, data, 0644)
+}
+
+func (script *Script) Path() string {
+	return script.path
+}
+
+func (script *Script) line() uuid.UUID {
+	if script.Line == nil {
+		return DefaultLine
+	}
+
+	return *script.Line
+}
+
+func (script *Script) user() uuid.UUID {
+	if script.User == nil {
+		return DefaultUser
+	}
+
+	return *script.User
+}
+
+// configure накладывает секции config сценария на копию настроек
+func (script *Script) configure(base *config.Conf) (*config.Conf, error) {
+	cnf := *base
+
+	target := reflect.ValueOf(&cnf).Elem()
+	for _, item := range script.Config {
+		key, _ := item.Key.(string)
+
+		field, ok := configField(target, key)
+		if !ok {
+			return nil, fmt.Errorf("unknown config section %q", key)
+		}
+
+		data, err := yaml.Marshal(yaml.MapSlice{item})
+		if err != nil {
+			return nil, err
+		}
+
+		var section config.Conf
+		if err = yaml.UnmarshalStrict(data, &section); err != nil {
+			return nil, fmt.Errorf("config section %s: %w", key, err)
+		}
+
+		sectionField, _ := configField(reflect.ValueOf(&section).Elem(), key)
+		field.Set(sectionField)
+	}
+
+	return &cnf, nil
+}
+
+func configField(conf reflect.Value, key string) (reflect.Value, bool) {
+	for i := 0; i < conf.NumField(); i++ {
+		tag := strings.Split(conf.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == key {
+			return conf.Field(i), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+// String описывает шаг для отчета
+func (step *Step) String() string {
+	switch {
+	case step.Send == SEND_TEXT:
+		return fmt.Sprintf("text %q", step.Text)
+	case step.File != "":
+		return "file " + step.File
+	case step.Redirect != "":
+		return step.Send + " " + step.Redirect
+	}
+
+	return step.Send
+}
+
+// String - строка протокола разговора
+func (reply Reply) String() string {
+	var line string
+	switch {
+	case reply.File != "":
+		line = "file: " + reply.File
+		if reply.Text != "" {
+			line += " (" + reply.Text + ")"
+		}
+	case reply.Action != "":
+		line = "action: " + reply.Action
+		if reply.Spec != "" {
+			line += " " + reply.Spec
+		}
+	default:
+		line = "text: " + reply.Text
+	}
+
+	for _, row := range reply.Keyboard {
+		line += " [" + strings.Join(row, " | ") + "]"
+	}
+
+	return line
+}
@@ -0,0 +1,17 @@
+package script
+
+import (
+	"testing"
+
+	"connect-companion/bot"
+	"connect-companion/config"
+)
+
+func TestScripts(t *testing.T) {
+	cnf := &config.Conf{FilesDir: "../../scripts/files"}
+	if err := bot.Configure(cnf); err != nil {
+		t.Fatal(err)
+	}
+
+	RunFiles(t, cnf, "../../scripts/*.yaml")
+}
@@ -0,0 +1,68 @@
+package script
+
+import (
+	"path/filepath"
+	"testing"
+
+	"connect-companion/config"
+)
+
+// RunFiles прогоняет сценарии по шаблонам путей как подтесты t:
+//
+//	func TestScripts(t *testing.T) {
+//		cnf := &config.Conf{FilesDir: "testdata/files"}
+//		if err := bot.Configure(cnf); err != nil {
+//			t.Fatal(err)
+//		}
+//		script.RunFiles(t, cnf, "testdata/*.yaml")
+//	}
+func RunFiles(t *testing.T, cnf *config.Conf, patterns ...string) {
+	t.Helper()
+
+	paths, err := Glob(patterns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no scripts found")
+	}
+
+	runner, err := NewRunner(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Close()
+
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			script, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := runner.Run(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Failures) > 0 {
+				t.Error("\n" + result.Report())
+			}
+		})
+	}
+}
+
+// Glob раскрывает шаблоны путей к сценариям
+func Glob(patterns ...string) ([]string, error) {
+	var paths []string
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,134 @@
+package bot
+
+import (
+	"connect-companion/config"
+	"connect-companion/database"
+)
+
+func init() {
+	defineStates(
+		&State{
+			Id:     database.STATE_MAIN_MENU,
+			Name:   "main_menu",
+			Prompt: BOT_PHRASE_GREETING,
+			Root:   true,
+			Sorry:  BOT_PHRASE_SORRY,
+			Menu: [][]Option{
+				{{Id: "1", Text: "Памятка сотрудника", Topic: "memo", File: "Памятка сотрудника.pdf"}},
+				{{Id: "2", Text: "Положение о персонале", Topic: "staff_regulations", File: "Положение о персонале.pdf"}},
+				{{Id: "3", Text: "Регламент о пожеланиях", Topic: "wishes", File: "Регламент.pdf"}},
+				{{Id: "6", Text: "Все документы", Goto: database.STATE_DOCUMENTS}},
+				{{Id: "4", Text: "Отправить больничный", Topic: "sick_leave", Goto: database.STATE_WAIT_SICK_LEAVE}},
+				{{Id: "5", Text: "Заявка на отпуск", Topic: "vacation", Form: "vacation"}},
+				{{Id: "9", Text: "Закрыть обращение", Action: ACTION_CLOSE}},
+				{{Id: "0", Text: "Перевести на специалиста", Action: ACTION_REROUTE}},
+			},
+		},
+		&State{
+			Id:       database.STATE_DOCUMENTS,
+			Name:     "documents",
+			Prompt:   BOT_PHRASE_DOCUMENTS,
+			Sorry:    BOT_PHRASE_SORRY,
+			Columns:  2,
+			PageSize: 8,
+			Catalog: []Option{
+				documentOption(config.Document{File: "Памятка сотрудника.pdf", Topic: "memo"}),
+				documentOption(config.Document{File: "Положение о персонале.pdf", Topic: "staff_regulations"}),
+				documentOption(config.Document{File: "Регламент.pdf", Title: "Регламент о пожеланиях", Topic: "wishes"}),
+			},
+			Menu: [][]Option{
+				{{Id: "0", Text: "Перевести на специалиста", Action: ACTION_REROUTE}},
+			},
+		},
+		&State{
+			Id:     database.STATE_WAIT_SICK_LEAVE,
+			Name:   "wait_sick_leave",
+			Prompt: BOT_PHRASE_SICK_LEAVE,
+			Menu: [][]Option{
+				{{Id: "0", Text: "Перевести на специалиста", Action: ACTION_REROUTE}},
+			},
+			OnFile: acceptFile("sick_leave", database.STATE_PARTING),
+		},
+		&State{
+			Id:     database.STATE_PARTING,
+			Name:   "parting",
+			Prompt: BOT_PHRASE_AGAIN,
+			Sorry:  BOT_PHRASE_SORRY,
+			Menu: [][]Option{
+				{{Id: "1", Text: "Да", Goto: database.STATE_MAIN_MENU}, {Id: "2", Text: "Нет", Action: ACTION_CLOSE}},
+				{{Id: "0", Text: "Перевести на специалиста", Action: ACTION_REROUTE}},
+			},
+		},
+		&State{
+			Id:         database.STATE_OFF_HOURS,
+			Name:       "off_hours",
+			PromptFunc: offHoursPhrase,
+			OnShow:     showOffHours,
+			// Сюда переводит reroute в нерабочее время
+			EnteredByCode: true,
+			Menu: [][]Option{
+				{{Id: "1", Text: "Оставить сообщение", Goto: database.STATE_LEAVE_MESSAGE}},
+				{{Id: "2", Text: "Нет, спасибо", Aliases: []string{"нет"}, Goto: database.STATE_MAIN_MENU}},
+			},
+		},
+		&State{
+			Id:     database.STATE_LEAVE_MESSAGE,
+			Name:   "leave_message",
+			Prompt: BOT_PHRASE_LEAVE_MESSAGE,
+			OnText: leaveMessage,
+		},
+		&State{
+			Id:     database.STATE_FORM,
+			Name:   "form",
+			OnShow: askField,
+			OnText: formInput,
+			OnBack: formBack,
+		},
+		&State{
+			Id:     database.STATE_SURVEY,
+			Name:   "survey",
+			Prompt: BOT_PHRASE_SURVEY,
+			Root:   true,
+			// Опрос начинается после закрытия обращения ботом или специалистом
+			EnteredByCode: true,
+			Menu: [][]Option{
+				{
+					{Id: "1", Text: "1", Do: rate(1)},
+					{Id: "2", Text: "2", Do: rate(2)},
+					{Id: "3", Text: "3", Do: rate(3)},
+					{Id: "4", Text: "4", Do: rate(4)},
+					{Id: "5", Text: "5", Do: rate(5)},
+				},
+			},
+			OnText: abandonSurvey,
+		},
+		&State{
+			Id:     database.STATE_SURVEY_COMMENT,
+			Name:   "survey_comment",
+			Prompt: BOT_PHRASE_SURVEY_COMMENT,
+			Root:   true,
+			// Сюда переводит оценка в опросе
+			EnteredByCode: true,
+			Menu: [][]Option{
+				{{Id: KEY_SKIP, Text: "Пропустить", Do: skipSurveyComment}},
+			},
+			OnText: surveyComment,
+		},
+	)
+
+	defineForms(
+		&Form{
+			Name:  "vacation",
+			Title: "Заявка на отпуск",
+			Fields: []Field{
+				{Name: "full_name", Title: "ФИО", Type: FIELD_TEXT, Prompt: "Укажите, пожалуйста, ваши фамилию, имя и отчество."},
+				{Name: "personnel_number", Title: "Табельный номер", Type: FIELD_REGEX, Pattern: `^\d{1,10}$`, Prompt: "Укажите ваш табельный номер.", Error: "Табельный номер состоит только из цифр."},
+				{Name: "vacation_kind", Title: "Вид отпуска", Type: FIELD_CHOICE, Choices: []string{"Ежегодный оплачиваемый", "Без сохранения заработной платы"}, Prompt: "Какой отпуск вы хотите оформить?"},
+				{Name: "period", Title: "Период", Type: FIELD_DATE_RANGE, Prompt: "Укажите даты отпуска, например: 01.07.2026 - 14.07.2026."},
+				{Name: "phone", Title: "Телефон", Type: FIELD_PHONE, Optional: true, Prompt: "Оставьте телефон для связи или нажмите «Пропустить»."},
+				{Name: "email", Title: "E-mail", Type: FIELD_EMAIL, Optional: true, Prompt: "Укажите e-mail, на который прислать копию заявления, или нажмите «Пропустить»."},
+			},
+			OnComplete: submitForm,
+		},
+	)
+}
@@ -0,0 +1,243 @@
+package survey
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+const (
+	GROUP_SPEC  = "spec"
+	GROUP_TOPIC = "topic"
+	GROUP_DAY   = "day"
+	GROUP_LINE  = "line"
+
+	// Обращение закрыл бот, а не специалист
+	SPEC_BOT = "bot"
+
+	// Защита от повторного опроса, когда о закрытии сообщают и бот, и push
+	STARTED_TTL = time.Minute
+)
+
+type (
+	// Stats - сводка оценок по группе
+	Stats struct {
+		Key     string  `json:"key" example:"70b8742d-8eb9-427c-b0db-bea80fefe6ca"`
+		Count   int     `json:"count" example:"12"`
+		Average float64 `json:"average" example:"4.5"`
+		// Доля оценок 4 и 5, в процентах
+		CSAT    float64 `json:"csat" example:"83.3"`
+		Ratings [5]int  `json:"ratings"`
+	}
+)
+
+func resultsKey(lineId uuid.UUID) string {
+	return database.PREFIX_SURVEY + "results:" + lineId.String()
+}
+
+// MarkStarted возвращает false, если опрос по этому чату уже начат недавно
+func MarkStarted(db redis.UniversalClient, lineId uuid.UUID, userId uuid.UUID) bool {
+	key := database.PREFIX_SURVEY + "started:" + userId.String() + ":" + lineId.String()
+
+	ok, err := db.SetNX(key, 1, STARTED_TTL).Result()
+	if err != nil {
+		logger.Warning("Error while mark survey started", err)
+
+		return true
+	}
+
+	return ok
+}
+
+// Save сохраняет оценку в хронологический список линии
+func Save(db redis.UniversalClient, result database.SurveyResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return db.ZAdd(resultsKey(result.LineId), &redis.Z{
+		Score:  float64(result.AnsweredAt.Unix()),
+		Member: data,
+	}).Err()
+}
+
+// Query возвращает оценки по линиям за период [from, to]
+func Query(db redis.UniversalClient, lines []uuid.UUID, from time.Time, to time.Time) ([]database.SurveyResult, error) {
+	var results []database.SurveyResult
+
+	for _, lineId := range lines {
+		items, err := db.ZRangeByScore(resultsKey(lineId), &redis.ZRangeBy{
+			Min: strconv.FormatInt(from.Unix(), 10),
+			Max: strconv.FormatInt(to.Unix(), 10),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			var result database.SurveyResult
+			if err := json.Unmarshal([]byte(item), &result); err != nil {
+				logger.Warning("Error while decoding survey result", err)
+				continue
+			}
+			results = append(results, result)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].AnsweredAt.Before(results[j].AnsweredAt)
+	})
+
+	return results, nil
+}
+
+// Aggregate считает сводку оценок с группировкой по специалисту, теме, дню или линии
+func Aggregate(results []database.SurveyResult, groupBy string) []Stats {
+	groups := map[string]*Stats{}
+	var keys []string
+
+	for _, result := range results {
+		key := groupKey(result, groupBy)
+
+		stats, ok := groups[key]
+		if !ok {
+			stats = &Stats{Key: key}
+			groups[key] = stats
+			keys = append(keys, key)
+		}
+
+		if result.Rating < 1 || result.Rating > 5 {
+			continue
+		}
+
+		stats.Count++
+		stats.Ratings[result.Rating-1]++
+	}
+
+	sort.Strings(keys)
+
+	list := make([]Stats, 0, len(keys))
+	for _, key := range keys {
+		stats := groups[key]
+		if stats.Count > 0 {
+			sum := 0
+			for i, n := range stats.Ratings {
+				sum += (i + 1) * n
+			}
+			stats.Average = float64(sum) / float64(stats.Count)
+			stats.CSAT = float64(stats.Ratings[3]+stats.Ratings[4]) * 100 / float64(stats.Count)
+		}
+		list = append(list, *stats)
+	}
+
+	return list
+}
+
+func groupKey(result database.SurveyResult, groupBy string) string {
+	switch groupBy {
+	case GROUP_SPEC:
+		if result.SpecId == nil {
+			return SPEC_BOT
+		}
+		return result.SpecId.String()
+	case GROUP_TOPIC:
+		return result.Topic
+	case GROUP_DAY:
+		return result.AnsweredAt.Format("2006-01-02")
+	case GROUP_LINE:
+		return result.LineId.String()
+	}
+
+	return "all"
+}
+
+// WriteCSV выгружает оценки в CSV
+func WriteCSV(w io.Writer, results []database.SurveyResult) error {
+	writer := csv.NewWriter(w)
+
+	_ = writer.Write([]string{"answered_at", "closed_at", "line_id", "user_id", "spec_id", "topic", "rating", "comment"})
+
+	for _, result := range results {
+		specId := SPEC_BOT
+		if result.SpecId != nil {
+			specId = result.SpecId.String()
+		}
+
+		err := writer.Write([]string{
+			result.AnsweredAt.Format(time.RFC3339),
+			result.ClosedAt.Format(time.RFC3339),
+			result.LineId.String(),
+			result.UserId.String(),
+			specId,
+			result.Topic,
+			strconv.Itoa(result.Rating),
+			result.Comment,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// ForUser возвращает оценки пользователя по всем линиям
+func ForUser(db redis.UniversalClient, userId uuid.UUID) ([]database.SurveyResult, error) {
+	return userResults(db, userId, false)
+}
+
+// Forget удаляет оценки пользователя и отметки о начатых опросах. Возвращает число удаленных оценок
+func Forget(db redis.UniversalClient, userId uuid.UUID) (int, error) {
+	err := database.ScanKeys(db, database.PREFIX_SURVEY+"started:"+userId.String()+":*", func(key string) error {
+		return db.Del(key).Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	results, err := userResults(db, userId, true)
+
+	return len(results), err
+}
+
+// userResults перебирает оценки всех линий и выбирает оценки пользователя, при remove - удаляя их
+func userResults(db redis.UniversalClient, userId uuid.UUID, remove bool) ([]database.SurveyResult, error) {
+	var results []database.SurveyResult
+
+	err := database.ScanKeys(db, database.PREFIX_SURVEY+"results:*", func(key string) error {
+		items, err := db.ZRange(key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			var result database.SurveyResult
+			if err := json.Unmarshal([]byte(item), &result); err != nil || result.UserId != userId {
+				continue
+			}
+
+			if remove {
+				if err = db.ZRem(key, item).Err(); err != nil {
+					return err
+				}
+			}
+			results = append(results, result)
+		}
+
+		return nil
+	})
+
+	return results, err
+}
@@ -0,0 +1,273 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"connect-companion/bot/messages"
+	"connect-companion/bot/schedule"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type (
+	// Profile - данные пользователя, доступные в шаблонах как .User
+	Profile struct {
+		Id     uuid.UUID
+		Name   string
+		Fields map[string]string
+	}
+
+	// ProfileLoader получает профиль пользователя, например из кадровой системы.
+	// Вызывается, только если шаблон обращается к .User. Без SetProfileLoader в профиле
+	// заполнен только Id: Name и Fields пусты
+	ProfileLoader func(ctx *Context) (*Profile, error)
+
+	// TemplateData - данные для шаблонов текстов:
+	//
+	//	{{greeting .Now}}, {{default "коллега" .Vars.full_name}}! Ваш отпуск: {{.Vars.period}}
+	TemplateData struct {
+		Vars  map[string]string
+		Topic string
+		Line  LineInfo
+		// Текущее время в часовом поясе линии
+		Now time.Time
+
+		ctx *Context
+	}
+
+	LineInfo struct {
+		Id   uuid.UUID
+		Name string
+	}
+)
+
+const (
+	// Сколько текстов из обработчиков разбирается при первой отправке и запоминается.
+	// Тексты сверх этого разбираются при каждой отправке
+	TEMPLATES_CACHE_MAX = 1000
+)
+
+var (
+	// Разобранные шаблоны по исходному тексту. Тексты без {{ выводятся как есть
+	templates   = map[string]*template.Template{}
+	templatesMu sync.RWMutex
+
+	// Подписи к документам по имени файла
+	captions = map[string]string{}
+
+	loadProfile ProfileLoader = func(ctx *Context) (*Profile, error) {
+		return &Profile{Id: ctx.Message.UserId}, nil
+	}
+	customProfile bool
+
+	// Поля профиля, которые заполняет только загрузчик
+	profileFields = regexp.MustCompile(`\.User\.(?:Name|Fields)`)
+
+	templateFuncs = template.FuncMap{
+		"greeting": greeting,
+		"date": func(t time.Time) string {
+			return t.Format(DATE_FORMAT)
+		},
+		"time": func(t time.Time) string {
+			return t.Format("15:04")
+		},
+		"default": func(def string, value string) string {
+			if value == "" {
+				return def
+			}
+			return value
+		},
+		"lower":  strings.ToLower,
+		"upper":  strings.ToUpper,
+		"title":  strings.Title,
+		"plural": plural,
+	}
+)
+
+// SetProfileLoader задает источник данных пользователя для шаблонов
+func SetProfileLoader(loader ProfileLoader) {
+	loadProfile = loader
+	customProfile = true
+}
+
+// usesProfile - обращается ли текст к полям профиля, которых без загрузчика нет
+func usesProfile(text string) bool {
+	return !customProfile && profileFields.MatchString(text)
+}
+
+// compileTemplate разбирает текст, если в нем есть подстановки
+func compileTemplate(text string) error {
+	_, err := templateOf(text, true)
+
+	return err
+}
+
+// templateOf возвращает разобранный шаблон текста или nil для текста без подстановок.
+// Неразобранный ранее текст разбирается, только если compile, иначе выводится как есть
+func templateOf(text string, compile bool) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+
+	templatesMu.RLock()
+	tmpl, ok := templates[text]
+	templatesMu.RUnlock()
+	if ok || !compile {
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New("").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	templatesMu.Lock()
+	if len(templates) < TEMPLATES_CACHE_MAX {
+		templates[text] = tmpl
+	}
+	templatesMu.Unlock()
+
+	return tmpl, nil
+}
+
+// mustCompileTemplate - для текстов из кода: ошибка в них - ошибка программиста
+func mustCompileTemplate(text string) {
+	if err := compileTemplate(text); err != nil {
+		panic(err)
+	}
+}
+
+// ConfigureTemplates подставляет тексты из конфигурации: приглашения состояний
+// по имени и подписи к документам по имени файла. Ошибки шаблонов выявляются здесь, при запуске
+func ConfigureTemplates(cnf *config.Conf) error {
+	for name, text := range cnf.Texts.Prompts {
+		state, ok := stateByName(name)
+		if !ok {
+			return fmt.Errorf("prompt for unknown state %q", name)
+		}
+		if err := compileTemplate(text); err != nil {
+			return fmt.Errorf("prompt of %s: %w", name, err)
+		}
+
+		state.Prompt = text
+		state.PromptFunc = nil
+	}
+
+	for fileName, text := range cnf.Texts.Captions {
+		if err := compileTemplate(text); err != nil {
+			return fmt.Errorf("caption of %s: %w", fileName, err)
+		}
+
+		captions[fileName] = text
+	}
+
+	return nil
+}
+
+// render подставляет в разобранный заранее шаблон данные чата. Остальной текст,
+// в том числе введенный пользователем, не изменяется
+func render(c *gin.Context, msg *messages.Message, chatState *database.Chat, text string) string {
+	tmpl, _ := templateOf(text, false)
+	if tmpl == nil {
+		return text
+	}
+
+	out, err := execute(c, msg, chatState, tmpl)
+	if err != nil {
+		logger.Warning("Error while render template", err)
+
+		return text
+	}
+
+	return out
+}
+
+// renderOnce - для текстов из обработчиков (Context.Send, Context.SendFile): шаблон разбирается
+// при первой отправке. Ввод пользователя в такой текст не вставляют, а передают через SetVar и .Vars
+func renderOnce(c *gin.Context, msg *messages.Message, chatState *database.Chat, text string) (string, error) {
+	tmpl, err := templateOf(text, true)
+	if err != nil {
+		return "", err
+	}
+	if tmpl == nil {
+		return text, nil
+	}
+
+	return execute(c, msg, chatState, tmpl)
+}
+
+func execute(c *gin.Context, msg *messages.Message, chatState *database.Chat, tmpl *template.Template) (string, error) {
+	cnf := c.MustGet("cnf").(*config.Conf)
+
+	data := &TemplateData{
+		Vars:  chatState.Vars,
+		Topic: chatState.Topic,
+		Line:  LineInfo{Id: msg.LineId, Name: cnf.Lines[msg.LineId].Name},
+		Now:   time.Now().In(schedule.ForLine(msg.LineId).Location()),
+		ctx:   &Context{Gin: c, Message: msg, Chat: chatState},
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// User загружает профиль пользователя один раз на сообщение
+func (data *TemplateData) User() *Profile {
+	if profile, ok := data.ctx.Gin.Get("profile"); ok {
+		return profile.(*Profile)
+	}
+
+	profile, err := loadProfile(data.ctx)
+	if err != nil || profile == nil {
+		logger.Warning("Error while load user profile", err)
+
+		profile = &Profile{Id: data.ctx.Message.UserId}
+	}
+	data.ctx.Gin.Set("profile", profile)
+
+	return profile
+}
+
+// greeting возвращает приветствие по времени суток
+func greeting(t time.Time) string {
+	switch h := t.Hour(); {
+	case h >= 5 && h < 12:
+		return "Доброе утро"
+	case h >= 12 && h < 18:
+		return "Добрый день"
+	case h >= 18 && h < 23:
+		return "Добрый вечер"
+	}
+
+	return "Доброй ночи"
+}
+
+// plural выбирает форму слова для числа: {{plural 5 "день" "дня" "дней"}}
+func plural(n int, one string, few string, many string) string {
+	if n < 0 {
+		n = -n
+	}
+
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return one
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+		return few
+	}
+
+	return many
+}
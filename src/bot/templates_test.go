@@ -0,0 +1,44 @@
+package bot
+
+import "testing"
+
+func TestTemplateOf(t *testing.T) {
+	text := "{{plural 2 \"день\" \"дня\" \"дней\"}} до отпуска"
+
+	if tmpl, err := templateOf(text, false); tmpl != nil || err != nil {
+		t.Fatalf("not compiled text: got %v, %v, want nil", tmpl, err)
+	}
+
+	first, err := templateOf(text, true)
+	if first == nil || err != nil {
+		t.Fatalf("first use: got %v, %v, want template", first, err)
+	}
+	if cached, _ := templateOf(text, false); cached != first {
+		t.Errorf("second use: template is not cached")
+	}
+
+	if tmpl, err := templateOf("без подстановок", true); tmpl != nil || err != nil {
+		t.Errorf("plain text: got %v, %v, want nil", tmpl, err)
+	}
+	if _, err := templateOf("{{.Vars.period", true); err == nil {
+		t.Errorf("broken template: want error")
+	}
+}
+
+func TestUsesProfile(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"{{greeting .Now}}, {{.User.Name}}!", true},
+		{`{{index .User.Fields "department"}}`, true},
+		{"{{.User.Id}}", false},
+		{`{{default "коллега" .Vars.full_name}}`, false},
+	}
+
+	for _, test := range tests {
+		if got := usesProfile(test.text); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"connect-companion/bot/client"
+	"connect-companion/bot/messages"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	UPLOADS_DEFAULT_DIR      = "./uploads"
+	UPLOADS_DEFAULT_MAX_SIZE = 10 << 20
+)
+
+var (
+	errUploadType = errors.New("file type is not allowed")
+
+	defaultAllowedTypes = []string{"application/pdf", "image/jpeg", "image/png"}
+
+	// Расширения сохраненных файлов по определенному типу. Расширению из имени файла
+	// пользователя не доверяем: PDF с именем file.html не должен стать file.html
+	uploadExtensions = map[string]string{
+		"application/pdf": ".pdf",
+		"image/jpeg":      ".jpg",
+		"image/png":       ".png",
+		"image/gif":       ".gif",
+		"image/webp":      ".webp",
+		"application/zip": ".zip",
+		"text/plain":      ".txt",
+	}
+)
+
+// acceptFile принимает файл в состоянии, которое его ожидает, и переходит в next
+func acceptFile(kind string, next database.ChatState) Action {
+	return func(c *gin.Context, msg *messages.Message, chatState *database.Chat) (database.ChatState, error) {
+		cnf := c.MustGet("cnf").(*config.Conf)
+		state := states[chatState.CurrentState]
+
+		_, err := receiveFile(cnf, msg, kind)
+		switch {
+		case err == client.ErrFileTooLarge:
+			return show(c, msg, chatState, state, BOT_PHRASE_FILE_TOO_LARGE)
+		case err == errUploadType:
+			return show(c, msg, chatState, state, BOT_PHRASE_FILE_TYPE_REJECTED)
+		case err != nil:
+			logger.Warning("Error while receive file from user", msg.UserId, err)
+
+			return show(c, msg, chatState, state, BOT_PHRASE_FILE_RECEIVE_FAILED)
+		}
+
+		msg.Send(c, BOT_PHRASE_FILE_RECEIVED, next, nil)
+
+		return enter(c, msg, chatState, next)
+	}
+}
+
+// receiveFile скачивает присланный пользователем файл, проверяет его и сохраняет
+// в каталог uploads/<user_id>/ вместе с метаданными.
+func receiveFile(cnf *config.Conf, msg *messages.Message, kind string) (*database.Upload, error) {
+	maxSize := cnf.Uploads.MaxSize
+	if maxSize <= 0 {
+		maxSize = UPLOADS_DEFAULT_MAX_SIZE
+	}
+
+	if msg.Data.FileSize > maxSize {
+		return nil, client.ErrFileTooLarge
+	}
+
+	userDir := UploadsDir(cnf, msg.UserId)
+	if err := os.MkdirAll(userDir, 0750); err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(userDir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	fileUrl := msg.Data.FileUrl
+	if fileUrl == "" {
+		fileUrl = "/line/file/" + msg.MessageID.String() + "/"
+	}
+
+	size, err := client.Download(fileUrl, tmp, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType, err := sniffContentType(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if !uploadTypeAllowed(cnf, contentType) {
+		logger.Info("Reject upload from", msg.UserId.String(), "with type", contentType)
+
+		return nil, errUploadType
+	}
+
+	fileName := filepath.Base(msg.Data.FileName)
+	if fileName == "." || fileName == string(filepath.Separator) {
+		fileName = ""
+	}
+
+	upload := &database.Upload{
+		MessageId:   msg.MessageID,
+		LineId:      msg.LineId,
+		UserId:      msg.UserId,
+		Kind:        kind,
+		FileName:    fileName,
+		StoredAs:    msg.MessageID.String() + uploadExtension(contentType),
+		ContentType: contentType,
+		Size:        size,
+		ReceivedAt:  time.Now(),
+	}
+
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(userDir, upload.StoredAs)); err != nil {
+		return nil, err
+	}
+
+	meta, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(userDir, msg.MessageID.String()+".json"), meta, 0640); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Upload", upload.Kind, "from", msg.UserId.String(), "stored as", upload.StoredAs)
+
+	return upload, nil
+}
+
+func sniffContentType(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	head := make([]byte, 512)
+	n, err := f.Read(head)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+
+	return contentType, err
+}
+
+// uploadExtension - расширение для определенного типа файла. Для неизвестного типа - .bin
+func uploadExtension(contentType string) string {
+	if ext, ok := uploadExtensions[strings.ToLower(contentType)]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		return exts[0]
+	}
+
+	return ".bin"
+}
+
+func uploadTypeAllowed(cnf *config.Conf, contentType string) bool {
+	allowed := cnf.Uploads.AllowedTypes
+	if len(allowed) == 0 {
+		allowed = defaultAllowedTypes
+	}
+
+	for i := range allowed {
+		if strings.EqualFold(allowed[i], contentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UploadsDir - каталог с файлами пользователя
+func UploadsDir(cnf *config.Conf, userId uuid.UUID) string {
+	dir := cnf.Uploads.Dir
+	if dir == "" {
+		dir = UPLOADS_DEFAULT_DIR
+	}
+
+	return filepath.Join(dir, userId.String())
+}
+
+// UploadsOf возвращает метаданные принятых от пользователя файлов. Сами файлы
+// лежат в UploadsDir под именем StoredAs
+func UploadsOf(cnf *config.Conf, userId uuid.UUID) ([]database.Upload, error) {
+	metas, err := filepath.Glob(filepath.Join(UploadsDir(cnf, userId), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []database.Upload
+	for _, meta := range metas {
+		data, err := ioutil.ReadFile(meta)
+		if err != nil {
+			return nil, err
+		}
+
+		var upload database.Upload
+		if err = json.Unmarshal(data, &upload); err != nil {
+			logger.Warning("Error while decoding upload", meta, err)
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, nil
+}
+
+// ForgetUploads удаляет все файлы пользователя. Возвращает число удаленных файлов
+func ForgetUploads(cnf *config.Conf, userId uuid.UUID) (int, error) {
+	uploads, err := UploadsOf(cnf, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(uploads), os.RemoveAll(UploadsDir(cnf, userId))
+}
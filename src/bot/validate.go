@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"errors"
+	"math"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FIELD_TEXT       = "text"
+	FIELD_DATE       = "date"
+	FIELD_DATE_RANGE = "date_range"
+	FIELD_PHONE      = "phone"
+	FIELD_EMAIL      = "email"
+	FIELD_NUMBER     = "number"
+	FIELD_REGEX      = "regex"
+	FIELD_CHOICE     = "choice"
+
+	DATE_FORMAT = "02.01.2006"
+)
+
+var (
+	errInvalidInput = errors.New("invalid input")
+
+	// Проверка ввода по типу поля. Возвращает нормализованное значение
+	validators = map[string]func(field *Field, input string) (string, error){
+		FIELD_TEXT:       validateText,
+		FIELD_DATE:       validateDate,
+		FIELD_DATE_RANGE: validateDateRange,
+		FIELD_PHONE:      validatePhone,
+		FIELD_EMAIL:      validateEmail,
+		FIELD_NUMBER:     validateNumber,
+		FIELD_REGEX:      validateRegex,
+		FIELD_CHOICE:     validateChoice,
+	}
+
+	dateLayouts = []string{DATE_FORMAT, "2.1.2006", "02.01.06", "2006-01-02"}
+
+	rangeSeparator = regexp.MustCompile(`\s*(?:-|—|–|по)\s*`)
+
+	// Число с необязательными знаком и дробной частью через точку или запятую
+	decimalPattern = regexp.MustCompile(`^[+-]?(?:\d+(?:[.,]\d*)?|[.,]\d+)$`)
+)
+
+func validateText(field *Field, input string) (string, error) {
+	if input == "" {
+		return "", errInvalidInput
+	}
+
+	return input, nil
+}
+
+func parseDate(input string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, input); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, errInvalidInput
+}
+
+func validateDate(field *Field, input string) (string, error) {
+	t, err := parseDate(input)
+	if err != nil {
+		return "", err
+	}
+
+	return t.Format(DATE_FORMAT), nil
+}
+
+// validateDateRange принимает "01.02.2026 - 14.02.2026", "с 01.02.2026 по 14.02.2026"
+// и "2026-02-01 - 2026-02-14". Дефис встречается и внутри дат, поэтому пробуем
+// каждый разделитель, пока обе части не окажутся датами
+func validateDateRange(field *Field, input string) (string, error) {
+	input = strings.TrimSpace(strings.TrimPrefix(strings.ToLower(input), "с "))
+
+	for _, loc := range rangeSeparator.FindAllStringIndex(input, -1) {
+		from, err := parseDate(input[:loc[0]])
+		if err != nil {
+			continue
+		}
+		to, err := parseDate(input[loc[1]:])
+		if err != nil {
+			continue
+		}
+		if to.Before(from) {
+			return "", errInvalidInput
+		}
+
+		return from.Format(DATE_FORMAT) + " - " + to.Format(DATE_FORMAT), nil
+	}
+
+	return "", errInvalidInput
+}
+
+// validatePhone приводит российские номера к виду +7XXXXXXXXXX
+func validatePhone(field *Field, input string) (string, error) {
+	var digits strings.Builder
+	for _, r := range input {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case strings.ContainsRune(" +-()", r):
+		default:
+			return "", errInvalidInput
+		}
+	}
+
+	phone := digits.String()
+	switch {
+	case len(phone) == 11 && (phone[0] == '8' || phone[0] == '7'):
+		return "+7" + phone[1:], nil
+	case len(phone) == 10 && phone[0] == '9':
+		return "+7" + phone, nil
+	case len(phone) >= 10 && len(phone) <= 15 && strings.HasPrefix(input, "+"):
+		return "+" + phone, nil
+	}
+
+	return "", errInvalidInput
+}
+
+func validateEmail(field *Field, input string) (string, error) {
+	addr, err := mail.ParseAddress(input)
+	if err != nil || addr.Address != input {
+		return "", errInvalidInput
+	}
+
+	return strings.ToLower(addr.Address), nil
+}
+
+// validateNumber принимает только десятичную запись: ParseFloat понимает еще NaN, Inf и 0x1p-2
+func validateNumber(field *Field, input string) (string, error) {
+	if !decimalPattern.MatchString(input) {
+		return "", errInvalidInput
+	}
+
+	n, err := strconv.ParseFloat(strings.Replace(input, ",", ".", 1), 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return "", errInvalidInput
+	}
+
+	return strconv.FormatFloat(n, 'f', -1, 64), nil
+}
+
+func validateRegex(field *Field, input string) (string, error) {
+	if !field.pattern.MatchString(input) {
+		return "", errInvalidInput
+	}
+
+	return input, nil
+}
+
+// validateChoice принимает вариант по тексту или по номеру кнопки
+func validateChoice(field *Field, input string) (string, error) {
+	for i, choice := range field.Choices {
+		if strings.EqualFold(input, choice) || input == strconv.Itoa(i+1) {
+			return choice, nil
+		}
+	}
+
+	return "", errInvalidInput
+}
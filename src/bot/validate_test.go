@@ -0,0 +1,95 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDateRange(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"01.07.2026 - 14.07.2026", "01.07.2026 - 14.07.2026", true},
+		{"01.07.2026-14.07.2026", "01.07.2026 - 14.07.2026", true},
+		{"с 1.7.2026 по 14.7.2026", "01.07.2026 - 14.07.2026", true},
+		{"01.07.2026 — 14.07.2026", "01.07.2026 - 14.07.2026", true},
+		{"01.07.26 – 14.07.26", "01.07.2026 - 14.07.2026", true},
+		{"2026-07-01 - 2026-07-14", "01.07.2026 - 14.07.2026", true},
+		{"2026-07-01-2026-07-14", "01.07.2026 - 14.07.2026", true},
+		{"2026-07-01 по 14.07.2026", "01.07.2026 - 14.07.2026", true},
+		{"14.07.2026 - 01.07.2026", "", false},
+		{"01.07.2026", "", false},
+		{"2026-07-01", "", false},
+		{"завтра - послезавтра", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := validateDateRange(nil, test.input)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("%q: got %q, %v, want %q", test.input, got, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: got %q, want error", test.input, got)
+		}
+	}
+}
+
+func TestValidatePhone(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"+7 999 123-45-67", "+79991234567", true},
+		{"8 (999) 123-45-67", "+79991234567", true},
+		{"9991234567", "+79991234567", true},
+		{"123", "", false},
+		{"+7 999 123-45-6x", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := validatePhone(nil, test.input)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("%q: got %q, %v, want %q", test.input, got, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: got %q, want error", test.input, got)
+		}
+	}
+}
+
+func TestValidateNumber(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"42", "42", true},
+		{"-3,5", "-3.5", true},
+		{"+0.25", "0.25", true},
+		{",5", "0.5", true},
+		{"NaN", "", false},
+		{"nan", "", false},
+		{"Inf", "", false},
+		{"+Inf", "", false},
+		{"-Infinity", "", false},
+		{"0x1p-2", "", false},
+		{"1e5", "", false},
+		{"1_000", "", false},
+		{"1" + strings.Repeat("0", 400), "", false},
+		{"", "", false},
+		{"12 штук", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := validateNumber(nil, test.input)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("%q: got %q, %v, want %q", test.input, got, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: got %q, want error", test.input, got)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"connect-companion/bot"
+	"connect-companion/bot/client"
+	"connect-companion/bot/privacy"
+	"connect-companion/bot/script"
+	"connect-companion/config"
+	"connect-companion/database"
+	"connect-companion/logger"
+
+	"github.com/google/uuid"
+)
+
+// runTests прогоняет сценарии разговоров:
+//
+//	connect-companion -config=config.yml -files=./files test [-update] scripts/*.yaml
+//
+// Без -config используются настройки по умолчанию. Возвращает код выхода
+func runTests(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	update := flags.Bool("update", false, "Write actual replies into scripts instead of checking them")
+	_ = flags.Parse(args)
+
+	if *configFile != "" {
+		config.GetConfig(*configFile, cnf)
+	}
+	logger.InitLogger(*debug)
+
+	patterns := flags.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"scripts/*.yaml"}
+	}
+
+	client.Configure(cnf)
+	if err := bot.Configure(cnf); err != nil {
+		fmt.Fprintln(os.Stderr, "Config:", err)
+		return 2
+	}
+
+	paths, err := script.Glob(patterns...)
+	if err != nil || len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "No scripts found:", err)
+		return 2
+	}
+
+	runner, err := script.NewRunner(cnf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer runner.Close()
+
+	failed := 0
+	for _, path := range paths {
+		s, err := script.Load(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+			continue
+		}
+
+		result, err := runner.Run(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			failed++
+			continue
+		}
+
+		if *update {
+			if err = result.Update(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+				failed++
+			} else {
+				fmt.Printf("UPDATED %s\n", path)
+			}
+			continue
+		}
+
+		if len(result.Failures) > 0 {
+			fmt.Printf("FAIL %s\n%s", path, result.Report())
+			failed++
+		} else {
+			fmt.Printf("ok   %s\n", path)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d scripts failed\n", failed, len(paths))
+		return 1
+	}
+
+	return 0
+}
+
+const (
+	SIMULATE_HELP = `Введите сообщение пользователя или команду:
+  #N               нажать N-ю кнопку клавиатуры
+  /file <путь>     отправить файл
+  /start           начало обращения
+  /close           специалист закрыл обращение
+  /to_bot [метка]  специалист перевел обращение на бота
+  /state           показать состояние чата
+  /reset           начать заново
+  /quit            выйти`
+)
+
+// runSimulate - диалог с ботом в терминале без Redis и Connect:
+//
+//	connect-companion -config=config.yml -files=./files simulate [-state=main_menu]
+func runSimulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	state := flags.String("state", "", "Initial chat state name or number")
+	_ = flags.Parse(args)
+
+	if *configFile != "" {
+		config.GetConfig(*configFile, cnf)
+	}
+	// Журнал мешает читать диалог, поэтому выводится только в режиме -debug
+	logger.InitLogger(*debug)
+	if !*debug {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	client.Configure(cnf)
+	if err := bot.Configure(cnf); err != nil {
+		fmt.Fprintln(os.Stderr, "Config:", err)
+		return 2
+	}
+
+	runner, err := script.NewRunner(cnf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer runner.Close()
+
+	header := &script.Script{Name: "simulate", State: *state}
+
+	session, err := runner.NewSession(header)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	fmt.Println(SIMULATE_HELP)
+
+	var keys []string
+	input := bufio.NewScanner(os.Stdin)
+
+	for {
+		fmt.Print("> ")
+		if !input.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(input.Text())
+		command := strings.Fields(line + " ")[0]
+		arg := strings.TrimSpace(strings.TrimPrefix(line, command))
+
+		var step script.Step
+		switch {
+		case line == "":
+			continue
+		case command == "/quit":
+			session.Close()
+			return 0
+		case command == "/help":
+			fmt.Println(SIMULATE_HELP)
+			continue
+		case command == "/reset":
+			session.Close()
+			if session, err = runner.NewSession(header); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			keys = nil
+			continue
+		case command == "/state":
+			chat, err := session.Chat()
+			if err != nil {
+				fmt.Println("!", err)
+				continue
+			}
+			data, _ := json.MarshalIndent(chat, "", "  ")
+			fmt.Printf("%s (%s)\n", data, bot.StateName(chat.CurrentState))
+			continue
+		case command == "/file":
+			step = script.Step{Send: script.SEND_FILE, File: arg}
+		case command == "/start":
+			step = script.Step{Send: script.SEND_START}
+		case command == "/close":
+			step = script.Step{Send: script.SEND_CLOSE}
+		case command == "/to_bot":
+			step = script.Step{Send: script.SEND_TO_BOT, Redirect: arg}
+		case strings.HasPrefix(line, "#"):
+			n, err := strconv.Atoi(line[1:])
+			if err != nil || n < 1 || n > len(keys) {
+				fmt.Println("! нет кнопки", line)
+				continue
+			}
+			fmt.Println("  [" + keys[n-1] + "]")
+			step = script.Step{Send: script.SEND_TEXT, Text: keys[n-1]}
+		default:
+			step = script.Step{Send: script.SEND_TEXT, Text: line}
+		}
+
+		result, err := session.Send(&step)
+		if err != nil {
+			fmt.Println("!", err)
+			continue
+		}
+
+		for _, reply := range result.Replies {
+			switch {
+			case reply.File != "":
+				fmt.Println("file sent:", reply.File)
+				if reply.Text != "" {
+					fmt.Println("бот:", reply.Text)
+				}
+			case reply.Action != "":
+				fmt.Println("treatment:", strings.TrimSpace(reply.Action+" "+reply.Spec))
+				if reply.Action == script.ACTION_DROP_KEYBOARD {
+					keys = nil
+				}
+			default:
+				fmt.Println("бот:", strings.Replace(reply.Text, "\n", "\n     ", -1))
+			}
+
+			if reply.Keyboard != nil {
+				keys = nil
+				for _, row := range reply.Keyboard {
+					var texts []string
+					for _, key := range row {
+						keys = append(keys, key)
+						texts = append(texts, fmt.Sprintf("#%d %s", len(keys), key))
+					}
+					fmt.Println("     " + strings.Join(texts, "   "))
+				}
+			}
+		}
+
+		fmt.Println("state:", result.State)
+	}
+
+	session.Close()
+
+	return 0
+}
+
+// runDiagram выводит схему диалога для Graphviz или Mermaid:
+//
+//	connect-companion -config=config.yml diagram [-format=mermaid] > flow.mmd
+//	connect-companion -config=config.yml diagram -format=dot | dot -Tsvg > flow.svg
+func runDiagram(args []string) int {
+	flags := flag.NewFlagSet("diagram", flag.ExitOnError)
+	format := flags.String("format", bot.DIAGRAM_MERMAID, "Output format: mermaid or dot")
+	_ = flags.Parse(args)
+
+	if *configFile != "" {
+		config.GetConfig(*configFile, cnf)
+	}
+	logger.InitLogger(*debug)
+
+	if err := bot.Configure(cnf); err != nil {
+		fmt.Fprintln(os.Stderr, "Config:", err)
+		return 2
+	}
+
+	if err := bot.WriteDiagram(os.Stdout, *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	return 0
+}
+
+// runLint проверяет описание диалогов. Код выхода 1, если есть ошибки,
+// с -strict - и при одних предупреждениях:
+//
+//	connect-companion -config=config.yml -files=./files lint [-strict]
+func runLint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	strict := flags.Bool("strict", false, "Fail on warnings too")
+	_ = flags.Parse(args)
+
+	if *configFile != "" {
+		config.GetConfig(*configFile, cnf)
+	}
+	logger.InitLogger(*debug)
+
+	if err := bot.Configure(cnf); err != nil {
+		fmt.Fprintln(os.Stderr, "Config:", err)
+		return 2
+	}
+
+	code := 0
+	for _, issue := range bot.Lint(cnf) {
+		fmt.Println(issue)
+		if issue.Level == bot.LINT_ERROR || *strict {
+			code = 1
+		}
+	}
+
+	return code
+}
+
+// runMigrate переводит сохраненные состояния чатов в текущую версию схемы.
+// С -dry-run только показывает, сколько записей изменится. Код выхода 1, если
+// какие-то записи не удалось прочитать:
+//
+//	connect-companion -config=config.yml migrate [-dry-run]
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Report what would change without writing")
+	_ = flags.Parse(args)
+
+	config.GetConfig(*configFile, cnf)
+	logger.InitLogger(*debug)
+
+	db, err := database.Connect(cnf.Database)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Redis:", err)
+		return 2
+	}
+	defer db.Close()
+
+	report, err := database.MigrateChats(db, *dryRun)
+	if report != nil {
+		fmt.Print(report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(report.Failed) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runPrivacy выгружает или удаляет данные пользователя по запросу субъекта персональных данных:
+//
+//	connect-companion -config=config.yml privacy export -user=<uuid> [-out=<uuid>.zip]
+//	connect-companion -config=config.yml privacy erase -user=<uuid>
+//
+// В журнал аудита пишется пользователь ОС, запустивший команду
+func runPrivacy(args []string) int {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "erase") {
+		fmt.Fprintln(os.Stderr, "Usage: privacy export|erase -user=<uuid>")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("privacy "+args[0], flag.ExitOnError)
+	user := flags.String("user", "", "User UUID")
+	out := flags.String("out", "", "Archive path, <user>.zip by default")
+	_ = flags.Parse(args[1:])
+
+	userId, err := uuid.Parse(*user)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad user:", err)
+		return 2
+	}
+
+	config.GetConfig(*configFile, cnf)
+	logger.InitLogger(*debug)
+
+	db, err := database.Connect(cnf.Database)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Redis:", err)
+		return 2
+	}
+	defer db.Close()
+
+	actor := "cli"
+	if name := os.Getenv("USER"); name != "" {
+		actor += ":" + name
+	}
+
+	if args[0] == "erase" {
+		erasure, err := privacy.Erase(db, cnf, userId, actor)
+		kinds := make([]string, 0, len(erasure.Deleted))
+		for kind := range erasure.Deleted {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			fmt.Printf("%s: %d\n", kind, erasure.Deleted[kind])
+		}
+		if erasure.Blocked {
+			fmt.Println("user is still blocked")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		return 0
+	}
+
+	data, err := privacy.Collect(db, cnf, userId)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	path := *out
+	if path == "" {
+		path = userId.String() + ".zip"
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	err = privacy.Export(db, cnf, data, actor, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(path)
+
+	return 0
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"connect-companion/database"
 
 	"github.com/gin-gonic/gin"
@@ -17,14 +19,40 @@ type (
 
 		Connect Connect `yaml:"connect"`
 
-		FilesDir string      `yaml:"files_dir"`
-		SpecID   *uuid.UUID  `yaml:"spec_id"`
-		Line     []uuid.UUID `yaml:"line"`
+		FilesDir    string      `yaml:"files_dir"`
+		MaxFileSize int64       `yaml:"max_file_size"`
+		SpecID      *uuid.UUID  `yaml:"spec_id"`
+		Line        []uuid.UUID `yaml:"line"`
+
+		Uploads Uploads `yaml:"uploads"`
+
+		BusinessHours *BusinessHours         `yaml:"business_hours"`
+		Lines         map[uuid.UUID]LineConf `yaml:"lines"`
+
+		Routing Routing `yaml:"routing"`
+
+		Survey Survey `yaml:"survey"`
+		Admin  Admin  `yaml:"admin"`
+		Audit  Audit  `yaml:"audit"`
+
+		Webhooks []Webhook `yaml:"webhooks"`
+
+		Middleware Middleware `yaml:"middleware"`
+		Profanity  Profanity  `yaml:"profanity"`
+		Flood      Flood      `yaml:"flood"`
+		Hooks      Hooks      `yaml:"hooks"`
+		Texts      Texts      `yaml:"texts"`
+		Documents  Documents  `yaml:"documents"`
+		Lint       Lint       `yaml:"lint"`
+
+		Experiments []Experiment `yaml:"experiments"`
 	}
 
 	Server struct {
 		Host   string `yaml:"host"`
 		Listen string `yaml:"listen"`
+		// Сколько при остановке ждать завершения начатых диалогов, по умолчанию 20s
+		DrainTimeout time.Duration `yaml:"drain_timeout"`
 	}
 
 	Connect struct {
@@ -32,6 +60,159 @@ type (
 		Login    string `yaml:"login"`
 		Password string `yaml:"password"`
 	}
+
+	// LineConf - индивидуальные настройки линии
+	LineConf struct {
+		Name  string         `yaml:"name"`
+		Hours *BusinessHours `yaml:"business_hours"`
+	}
+
+	// BusinessHours - рабочее время специалистов линии
+	BusinessHours struct {
+		TimeZone     string            `yaml:"time_zone"`
+		Week         map[string]string `yaml:"week"`
+		Holidays     []string          `yaml:"holidays"`
+		CalendarFile string            `yaml:"calendar_file"`
+	}
+
+	// Routing - правила перевода обращений на конкретных специалистов
+	Routing struct {
+		Rules []RoutingRule `yaml:"rules"`
+	}
+
+	// RoutingRule срабатывает, если совпали все заданные условия.
+	// Пустое условие подходит всем.
+	RoutingRule struct {
+		Name     string         `yaml:"name"`
+		Topics   []string       `yaml:"topics"`
+		Lines    []uuid.UUID    `yaml:"lines"`
+		Users    []uuid.UUID    `yaml:"users"`
+		Hours    *BusinessHours `yaml:"business_hours"`
+		Specs    []uuid.UUID    `yaml:"specs"`
+		Strategy string         `yaml:"strategy"`
+	}
+
+	// Survey - опрос об удовлетворенности после закрытия обращения
+	Survey struct {
+		Enabled bool `yaml:"enabled"`
+		Comment bool `yaml:"comment"`
+	}
+
+	// Admin - доступ к административным методам. Без логина методы отключены
+	Admin struct {
+		Login    string `yaml:"login"`
+		Password string `yaml:"password"`
+	}
+
+	// Webhook - внешний адрес, которому бот отправляет события.
+	// Пустой список events - все события
+	Webhook struct {
+		Url         string        `yaml:"url"`
+		Secret      string        `yaml:"secret"`
+		Events      []string      `yaml:"events"`
+		MaxAttempts int           `yaml:"max_attempts"`
+		Timeout     time.Duration `yaml:"timeout"`
+	}
+
+	// Middleware - порядок обработчиков входящих сообщений и исходящих вызовов API
+	Middleware struct {
+		Inbound  []string `yaml:"inbound"`
+		Outbound []string `yaml:"outbound"`
+	}
+
+	Profanity struct {
+		Words []string `yaml:"words"`
+	}
+
+	// Documents - каталог документов из files_dir. Пустой список items и scan: false -
+	// каталог по умолчанию
+	Documents struct {
+		Columns  int        `yaml:"columns"`
+		PageSize int        `yaml:"page_size"`
+		Items    []Document `yaml:"items"`
+		// Добавить в каталог остальные документы из files_dir в алфавитном порядке
+		Scan bool `yaml:"scan"`
+	}
+
+	Document struct {
+		File  string `yaml:"file"`
+		Title string `yaml:"title"`
+		Topic string `yaml:"topic"`
+	}
+
+	// Texts - тексты бота в формате text/template: приглашения состояний по имени
+	// состояния и подписи к документам по имени файла
+	Texts struct {
+		Prompts  map[string]string `yaml:"prompts"`
+		Captions map[string]string `yaml:"captions"`
+	}
+
+	// Experiment - A/B-эксперимент: чаты делятся между вариантами по UserId,
+	// вариант запоминается в состоянии чата
+	Experiment struct {
+		Name     string    `yaml:"name"`
+		Variants []Variant `yaml:"variants"`
+	}
+
+	// Variant - вариант эксперимента. Weight - доля чатов относительно других вариантов,
+	// по умолчанию 1. Prompts - тексты состояний по имени, Menus - порядок пунктов меню
+	// по их Id, States - какое состояние показывать вместо указанного
+	Variant struct {
+		Name    string              `yaml:"name"`
+		Weight  int                 `yaml:"weight"`
+		Prompts map[string]string   `yaml:"prompts"`
+		Menus   map[string][]string `yaml:"menus"`
+		States  map[string]string   `yaml:"states"`
+	}
+
+	// Audit - журнал действий бота и администраторов
+	Audit struct {
+		// Примерно столько последних записей хранится, по умолчанию 1000000
+		MaxLen int64 `yaml:"max_len"`
+	}
+
+	// Lint - проверка описания диалогов при запуске
+	Lint struct {
+		// Не запускаться, если найдены ошибки, а не только предупреждения
+		Strict bool `yaml:"strict"`
+	}
+
+	// Hooks - поддержка регистрации хуков бота на линиях
+	Hooks struct {
+		// Как часто проверять, что хук установлен, по умолчанию 5m
+		CheckInterval time.Duration `yaml:"check_interval"`
+		// Не снимать хуки при остановке: при перезапуске или нескольких экземплярах
+		// за балансировщиком линия не остается без бота
+		KeepOnShutdown bool `yaml:"keep_on_shutdown"`
+	}
+
+	// Flood - ограничение частоты входящих сообщений. Лимиты считаются в памяти процесса,
+	// временные блокировки и черный список из админки хранятся в Redis
+	Flood struct {
+		User RateLimit `yaml:"user"`
+		Line RateLimit `yaml:"line"`
+		// Не чаще раза в window бот просит писать реже. Если после этого сообщения
+		// продолжаются, пользователь блокируется на mute, повторно - вдвое дольше, до max_mute
+		Window    time.Duration `yaml:"window"`
+		Mute      time.Duration `yaml:"mute"`
+		MaxMute   time.Duration `yaml:"max_mute"`
+		Blocklist []uuid.UUID   `yaml:"blocklist"`
+	}
+
+	// RateLimit - rate сообщений в секунду, но не больше burst подряд
+	RateLimit struct {
+		Rate  float64 `yaml:"rate"`
+		Burst int     `yaml:"burst"`
+	}
+
+	// Uploads - настройки приема файлов от пользователей
+	Uploads struct {
+		Dir          string   `yaml:"dir"`
+		MaxSize      int64    `yaml:"max_size"`
+		AllowedTypes []string `yaml:"allowed_types"`
+		// Хосты, с которых кроме сервера Connect можно скачивать файлы по file_url
+		AllowedHosts []string `yaml:"allowed_hosts"`
+	}
 )
 
 func Inject(cnf *Conf) gin.HandlerFunc {
@@ -1,6 +1,12 @@
 package database
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -8,27 +14,227 @@ import (
 )
 
 type (
+	// Redis - подключение к одному серверу, к мастеру через sentinel (master_name)
+	// или к кластеру (cluster: true). Для sentinel и кластера адреса узлов - в addrs
 	Redis struct {
-		Addr     string `yaml:"addr"`
+		Addr  string   `yaml:"addr"`
+		Addrs []string `yaml:"addrs"`
+
+		MasterName       string `yaml:"master_name"`
+		SentinelPassword string `yaml:"sentinel_password"`
+		Cluster          bool   `yaml:"cluster"`
+
+		// Username - пользователь ACL (Redis 6+). Без него password - общий пароль сервера
+		Username string `yaml:"username"`
 		Password string `yaml:"password"`
+		// Номер базы. В кластере доступна только 0
+		DB int `yaml:"db"`
+
+		PoolSize     int `yaml:"pool_size"`
+		MinIdleConns int `yaml:"min_idle_conns"`
+
+		TLS *TLS `yaml:"tls"`
+
+		// Префикс всех ключей бота, чтобы делить Redis с другими сервисами
+		Namespace string `yaml:"namespace"`
+	}
+
+	// TLS - шифрование соединений. CA - сертификат центра, если сервер подписан не публичным,
+	// Cert и Key - клиентский сертификат, если сервер его требует
+	TLS struct {
+		CA                 string `yaml:"ca"`
+		Cert               string `yaml:"cert"`
+		Key                string `yaml:"key"`
+		ServerName         string `yaml:"server_name"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 	}
 )
 
 const (
-	PREFIX_STATE = "demo_bot:chat_state:"
-	EXPIRE       = 30 * 24 * time.Hour
+	DEFAULT_NAMESPACE      = "demo_bot:"
+	DEFAULT_MIN_IDLE_CONNS = 3
+
+	EXPIRE = 30 * 24 * time.Hour
+)
+
+// Префиксы ключей. Зависят от namespace, поэтому задаются в SetNamespace
+var (
+	PREFIX_STATE      string
+	PREFIX_PENDING    string
+	PREFIX_ROUTING    string
+	PREFIX_SURVEY     string
+	PREFIX_WEBHOOK    string
+	PREFIX_DEDUPE     string
+	PREFIX_FLOOD      string
+	PREFIX_EXPERIMENT string
+	PREFIX_AUDIT      string
 )
 
-func Connect(d Redis) *redis.Client {
+func init() {
+	SetNamespace(DEFAULT_NAMESPACE)
+}
+
+// SetNamespace меняет префикс всех ключей. Вызывается до начала работы с Redis
+func SetNamespace(namespace string) {
+	PREFIX_STATE = namespace + "chat_state:"
+	PREFIX_PENDING = namespace + "pending:"
+	PREFIX_ROUTING = namespace + "routing:"
+	PREFIX_SURVEY = namespace + "survey:"
+	PREFIX_WEBHOOK = namespace + "webhook:"
+	PREFIX_DEDUPE = namespace + "dedupe:"
+	PREFIX_FLOOD = namespace + "flood:"
+	PREFIX_EXPERIMENT = namespace + "experiment:"
+	PREFIX_AUDIT = namespace + "audit:"
+}
+
+// Connect создает клиент Redis и применяет namespace. Соединения открываются при первом запросе
+func Connect(d Redis) (redis.UniversalClient, error) {
+	if d.Namespace != "" {
+		SetNamespace(d.Namespace)
+	}
+
+	var tlsConfig *tls.Config
+	if d.TLS != nil {
+		var err error
+		if tlsConfig, err = d.TLS.config(); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+
+	minIdleConns := d.MinIdleConns
+	if minIdleConns == 0 {
+		minIdleConns = DEFAULT_MIN_IDLE_CONNS
+	}
+
+	addrs := d.Addrs
+	if len(addrs) == 0 && d.Addr != "" {
+		addrs = []string{d.Addr}
+	}
+
+	// go-redis v7 не умеет AUTH с пользователем, поэтому при username
+	// авторизация и выбор базы выполняются при каждом новом соединении
+	password, db := d.Password, d.DB
+	var onConnect func(conn *redis.Conn) error
+	if d.Username != "" {
+		password, db = "", 0
+		onConnect = func(conn *redis.Conn) error {
+			if err := conn.Process(redis.NewStatusCmd("auth", d.Username, d.Password)); err != nil {
+				return err
+			}
+			if d.DB != 0 {
+				return conn.Select(d.DB).Err()
+			}
+			return nil
+		}
+	}
+
+	switch {
+	case d.Cluster && d.MasterName != "":
+		return nil, errors.New("cluster and master_name are mutually exclusive")
+	case d.Cluster:
+		if d.DB != 0 {
+			return nil, errors.New("cluster supports only db 0")
+		}
+
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			OnConnect:    onConnect,
+			Password:     password,
+			PoolSize:     d.PoolSize,
+			MinIdleConns: minIdleConns,
+			TLSConfig:    tlsConfig,
+		}), nil
+	case d.MasterName != "":
+		if len(addrs) == 0 {
+			return nil, errors.New("no sentinel addrs")
+		}
+
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       d.MasterName,
+			SentinelAddrs:    addrs,
+			SentinelPassword: d.SentinelPassword,
+			OnConnect:        onConnect,
+			Password:         password,
+			DB:               db,
+			PoolSize:         d.PoolSize,
+			MinIdleConns:     minIdleConns,
+			TLSConfig:        tlsConfig,
+		}), nil
+	}
+
+	if len(addrs) > 1 {
+		return nil, errors.New("several addrs need master_name or cluster")
+	}
+
 	return redis.NewClient(&redis.Options{
-		Addr:         d.Addr,     // use default Addr
-		Password:     d.Password, // no password set
-		DB:           0,          // use default DB
-		MinIdleConns: 3,
-	})
+		Addr:         d.Addr,
+		OnConnect:    onConnect,
+		Password:     password,
+		DB:           db,
+		PoolSize:     d.PoolSize,
+		MinIdleConns: minIdleConns,
+		TLSConfig:    tlsConfig,
+	}), nil
+}
+
+func (t *TLS) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.CA)
+		}
+	}
+
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// ScanKeys перебирает ключи по шаблону. В кластере обходит все мастера,
+// fn при этом вызывается по очереди
+func ScanKeys(db redis.UniversalClient, match string, fn func(key string) error) error {
+	var mu sync.Mutex
+
+	scan := func(client redis.Cmdable) error {
+		iter := client.Scan(0, match, 100).Iterator()
+		for iter.Next() {
+			mu.Lock()
+			err := fn(iter.Val())
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
+		return iter.Err()
+	}
+
+	if cluster, ok := db.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(client *redis.Client) error {
+			return scan(client)
+		})
+	}
+
+	return scan(db)
 }
 
-func Inject(key string, redis *redis.Client) gin.HandlerFunc {
+func Inject(key string, redis redis.UniversalClient) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Set(key, redis)
 	}
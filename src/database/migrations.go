@@ -0,0 +1,209 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/go-redis/redis/v7"
+)
+
+type (
+	// Migration переводит сохраненное состояние чата из версии Version-1 в Version.
+	// Работает с сырым JSON, потому что старая запись может не подходить под текущий Chat
+	Migration struct {
+		Version int
+		Name    string
+		Up      func(record map[string]interface{}) error
+	}
+
+	// MigrationReport - итог массовой миграции состояний чатов
+	MigrationReport struct {
+		DryRun bool `json:"dry_run"`
+		Total  int  `json:"total"`
+		// Записи, уже сохраненные в текущей версии
+		Current int `json:"current"`
+		// Записи новее кода, например от обновленного экземпляра: остаются как есть
+		Newer int `json:"newer,omitempty"`
+		// Сколько записей обновлено (или было бы обновлено) из каждой версии
+		Migrated map[int]int       `json:"migrated"`
+		Failed   map[string]string `json:"failed,omitempty"`
+	}
+)
+
+var (
+	migrations []Migration
+
+	// ErrChatNewer - запись сохранил код с более новой схемой. Ее нельзя ни прочитать,
+	// ни перезаписать: при поэтапном обновлении ее продолжит новый экземпляр
+	ErrChatNewer = errors.New("chat state is saved by a newer version")
+)
+
+func init() {
+	// Записи до появления версии отличаются от первой версии только ее отсутствием
+	RegisterMigration(Migration{Version: 1, Name: "add version", Up: func(record map[string]interface{}) error {
+		return nil
+	}})
+}
+
+// RegisterMigration добавляет миграцию. Версии должны идти подряд, начиная с 1:
+// пропущенная версия - ошибка программиста, поэтому паника при старте
+func RegisterMigration(migration Migration) {
+	if migration.Version != len(migrations)+1 {
+		panic(fmt.Sprintf("database: migration %d registered after %d", migration.Version, len(migrations)))
+	}
+
+	migrations = append(migrations, migration)
+}
+
+// ChatVersion - версия схемы, в которой сохраняется состояние чата
+func ChatVersion() int {
+	return len(migrations)
+}
+
+// EncodeChat сериализует состояние чата с текущей версией схемы
+func EncodeChat(chat *Chat) ([]byte, error) {
+	chat.Version = ChatVersion()
+
+	return json.Marshal(chat)
+}
+
+// DecodeChat читает состояние чата любой известной версии, применяя недостающие миграции.
+// from - версия сохраненной записи. Запись новее кода (ErrChatNewer) или с лишними полями -
+// ошибка, чтобы не прочитать ее молча в неверное состояние
+func DecodeChat(data []byte) (chat Chat, from int, err error) {
+	var record map[string]interface{}
+	if err = json.Unmarshal(data, &record); err != nil {
+		return chat, 0, err
+	}
+
+	if raw, ok := record["version"]; ok {
+		version, ok := raw.(float64)
+		if !ok || version != float64(int(version)) || version < 0 {
+			return chat, 0, fmt.Errorf("bad version %v", raw)
+		}
+		from = int(version)
+	}
+	if from > ChatVersion() {
+		return chat, from, fmt.Errorf("%w: version %d, supported %d", ErrChatNewer, from, ChatVersion())
+	}
+
+	for _, migration := range migrations[from:] {
+		if err = migration.Up(record); err != nil {
+			return chat, from, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+	}
+	record["version"] = ChatVersion()
+
+	if from < ChatVersion() {
+		if data, err = json.Marshal(record); err != nil {
+			return chat, from, err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&chat); err != nil {
+		return chat, from, err
+	}
+	chat.Version = ChatVersion()
+
+	return chat, from, nil
+}
+
+// MigrateChats переводит все сохраненные состояния чатов в текущую версию.
+// При dryRun только считает, что изменилось бы. Срок жизни ключей сохраняется
+func MigrateChats(db redis.UniversalClient, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{DryRun: dryRun, Migrated: map[int]int{}, Failed: map[string]string{}}
+
+	err := ScanKeys(db, PREFIX_STATE+"*", func(key string) error {
+		err := db.Watch(func(tx *redis.Tx) error {
+			data, err := tx.Get(key).Bytes()
+			if err == redis.Nil {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			report.Total++
+
+			chat, from, err := DecodeChat(data)
+			if errors.Is(err, ErrChatNewer) {
+				report.Newer++
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if from == ChatVersion() {
+				report.Current++
+				return nil
+			}
+
+			report.Migrated[from]++
+			if dryRun {
+				return nil
+			}
+
+			ttl, err := tx.TTL(key).Result()
+			if err != nil {
+				return err
+			}
+			if ttl < 0 {
+				ttl = 0
+			}
+
+			if data, err = EncodeChat(&chat); err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				return pipe.Set(key, data, ttl).Err()
+			})
+
+			return err
+		}, key)
+		if err != nil {
+			report.Failed[key] = err.Error()
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+// String - отчет для командной строки
+func (report *MigrationReport) String() string {
+	var b bytes.Buffer
+
+	action := "migrated"
+	if report.DryRun {
+		action = "to migrate"
+	}
+
+	fmt.Fprintf(&b, "chat states: %d, current version %d: %d\n", report.Total, ChatVersion(), report.Current)
+	if report.Newer > 0 {
+		fmt.Fprintf(&b, "newer than version %d, left as is: %d\n", ChatVersion(), report.Newer)
+	}
+
+	versions := make([]int, 0, len(report.Migrated))
+	for version := range report.Migrated {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	for _, version := range versions {
+		fmt.Fprintf(&b, "%s from version %d: %d\n", action, version, report.Migrated[version])
+	}
+
+	keys := make([]string, 0, len(report.Failed))
+	for key := range report.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "failed %s: %s\n", key, report.Failed[key])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDecodeChat(t *testing.T) {
+	current := strconv.Itoa(ChatVersion())
+	newer := strconv.Itoa(ChatVersion() + 1)
+
+	tests := []struct {
+		name  string
+		data  string
+		from  int
+		state ChatState
+		ok    bool
+	}{
+		{"before versioning", `{"prev_state":100,"curr_state":300}`, 0, 300, true},
+		{"current", `{"version":` + current + `,"prev_state":300,"curr_state":310,"vars":{"a":"b"}}`, ChatVersion(), 310, true},
+		{"newer than code", `{"version":` + newer + `,"curr_state":300}`, ChatVersion() + 1, 0, false},
+		{"unknown field", `{"version":` + current + `,"curr_state":300,"mood":"good"}`, ChatVersion(), 0, false},
+		{"bad version", `{"version":"one","curr_state":300}`, 0, 0, false},
+		{"fractional version", `{"version":1.5,"curr_state":300}`, 0, 0, false},
+		{"not json", `chat`, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		chat, from, err := DecodeChat([]byte(test.data))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if from != test.from {
+			t.Errorf("%s: from %d, want %d", test.name, from, test.from)
+		}
+		if !test.ok {
+			continue
+		}
+		if chat.CurrentState != test.state || chat.Version != ChatVersion() {
+			t.Errorf("%s: got state %d version %d", test.name, chat.CurrentState, chat.Version)
+		}
+	}
+}
+
+func TestEncodeChatRoundTrip(t *testing.T) {
+	chat := Chat{CurrentState: 300, Vars: map[string]string{"period": "01.07.2026 - 14.07.2026"}}
+
+	data, err := EncodeChat(&chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, from, err := DecodeChat(data)
+	if err != nil || from != ChatVersion() {
+		t.Fatalf("got from %d, %v", from, err)
+	}
+	if decoded.CurrentState != chat.CurrentState || decoded.Vars["period"] != chat.Vars["period"] {
+		t.Errorf("got %+v", decoded)
+	}
+}
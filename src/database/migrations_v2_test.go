@@ -0,0 +1,136 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+// Схема v2 из фикстуры testdata/chat_v1.json: переменные были списком пар name/value
+// и хранилось поле lang, которое больше не используется
+var varsAsMap = Migration{Version: 2, Name: "vars as map, drop lang", Up: func(record map[string]interface{}) error {
+	delete(record, "lang")
+
+	list, ok := record["vars"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	vars := map[string]interface{}{}
+	for _, item := range list {
+		pair, ok := item.(map[string]interface{})
+		name, _ := pair["name"].(string)
+		if !ok || name == "" {
+			return fmt.Errorf("bad var %v", item)
+		}
+		vars[name] = pair["value"]
+	}
+	record["vars"] = vars
+
+	return nil
+}}
+
+// withV2 регистрирует миграцию v2 на время теста
+func withV2(t *testing.T) {
+	t.Helper()
+
+	registered := migrations
+	t.Cleanup(func() { migrations = registered })
+
+	migrations = append([]Migration{}, registered...)
+	RegisterMigration(varsAsMap)
+}
+
+func readFixture(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile("testdata/chat_v1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestDecodeChatV1ToV2(t *testing.T) {
+	data := readFixture(t)
+
+	// Без миграции запись v1 не подходит под Chat: vars - список, lang - лишнее поле
+	if _, _, err := DecodeChat(data); err == nil {
+		t.Fatal("v1 record decoded without v2 migration")
+	}
+
+	withV2(t)
+
+	chat, from, err := DecodeChat(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 || chat.Version != 2 {
+		t.Errorf("got from %d, version %d, want 1 and 2", from, chat.Version)
+	}
+	if chat.CurrentState != 340 || chat.Topic != "vacation" || chat.Form == nil || chat.Form.Field != 2 {
+		t.Errorf("got %+v", chat)
+	}
+	if chat.Vars["period"] != "01.07.2026 - 14.07.2026" || chat.Vars["full_name"] != "Иванова Анна" {
+		t.Errorf("got vars %v", chat.Vars)
+	}
+}
+
+func TestMigrateChatsV1ToV2(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mini.Close()
+	db := redis.NewClient(&redis.Options{Addr: mini.Addr()})
+
+	old, newer, broken := PREFIX_STATE+"user:old", PREFIX_STATE+"user:newer", PREFIX_STATE+"user:broken"
+	newerData := `{"version":3,"curr_state":300,"mood":"good"}`
+	mini.Set(old, string(readFixture(t)))
+	mini.SetTTL(old, time.Hour)
+	mini.Set(newer, newerData)
+	mini.Set(broken, `{"version":1,"curr_state":300,"vars":["period"]}`)
+
+	withV2(t)
+
+	report, err := MigrateChats(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 3 || report.Migrated[1] != 1 || report.Newer != 1 || len(report.Failed) != 1 {
+		t.Fatalf("dry run: got %+v", report)
+	}
+	if data, _ := mini.Get(old); data != string(readFixture(t)) {
+		t.Errorf("dry run changed %s", old)
+	}
+
+	if report, err = MigrateChats(db, false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated[1] != 1 || report.Newer != 1 || report.Failed[broken] == "" {
+		t.Errorf("migrate: got %+v", report)
+	}
+
+	data, _ := mini.Get(old)
+	chat, from, err := DecodeChat([]byte(data))
+	if err != nil || from != 2 || chat.Vars["period"] != "01.07.2026 - 14.07.2026" {
+		t.Errorf("migrated record: got %s, from %d, %v", data, from, err)
+	}
+	if ttl := mini.TTL(old); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("migrated record: ttl %v, want kept", ttl)
+	}
+
+	// Запись новее кода не перезаписывается и не считается ошибкой
+	if data, _ := mini.Get(newer); data != newerData {
+		t.Errorf("newer record changed: %s", data)
+	}
+	if _, _, err := DecodeChat([]byte(newerData)); !errors.Is(err, ErrChatNewer) {
+		t.Errorf("newer record: got %v, want ErrChatNewer", err)
+	}
+}
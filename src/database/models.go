@@ -1,11 +1,78 @@
 package database
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
 type (
 	ChatState int
 
 	Chat struct {
-		PreviousState ChatState `json:"prev_state" binding:"required" example:"100"`
-		CurrentState  ChatState `json:"curr_state" binding:"required" example:"300"`
+		// Версия схемы записи, см. RegisterMigration
+		Version int `json:"version" example:"1"`
+
+		PreviousState ChatState   `json:"prev_state" binding:"required" example:"100"`
+		CurrentState  ChatState   `json:"curr_state" binding:"required" example:"300"`
+		Topic         string      `json:"topic,omitempty" example:"sick_leave"`
+		History       []ChatState `json:"history,omitempty" example:"300,310"`
+		// Страница каталога текущего состояния, с нуля
+		Page int `json:"page,omitempty" example:"1"`
+
+		Vars   map[string]string `json:"vars,omitempty"`
+		Form   *FormProgress     `json:"form,omitempty"`
+		Survey *SurveyProgress   `json:"survey,omitempty"`
+		// Варианты A/B-экспериментов: эксперимент -> вариант
+		Experiments map[string]string `json:"experiments,omitempty"`
+	}
+
+	// FormProgress - какую форму заполняет пользователь и на каком он поле
+	FormProgress struct {
+		Name  string `json:"name" example:"vacation"`
+		Field int    `json:"field" example:"2"`
+	}
+
+	// SurveyProgress - опрос, который проходит пользователь после закрытия обращения
+	SurveyProgress struct {
+		SpecId   *uuid.UUID `json:"spec_id,omitempty"`
+		Topic    string     `json:"topic,omitempty"`
+		Rating   int        `json:"rating,omitempty"`
+		ClosedAt time.Time  `json:"closed_at"`
+	}
+
+	// SurveyResult - оценка обращения. SpecId пустой, если обращение закрыл бот
+	SurveyResult struct {
+		LineId     uuid.UUID  `json:"line_id"`
+		UserId     uuid.UUID  `json:"user_id"`
+		SpecId     *uuid.UUID `json:"spec_id,omitempty"`
+		Topic      string     `json:"topic,omitempty" example:"sick_leave"`
+		Rating     int        `json:"rating" example:"5"`
+		Comment    string     `json:"comment,omitempty" example:"Быстро и понятно"`
+		ClosedAt   time.Time  `json:"closed_at"`
+		AnsweredAt time.Time  `json:"answered_at"`
+	}
+
+	// Upload - метаданные принятого от пользователя файла
+	Upload struct {
+		MessageId   uuid.UUID `json:"message_id"`
+		LineId      uuid.UUID `json:"line_id"`
+		UserId      uuid.UUID `json:"user_id"`
+		Kind        string    `json:"kind" example:"sick_leave"`
+		FileName    string    `json:"file_name" example:"scan.pdf"`
+		StoredAs    string    `json:"stored_as"`
+		ContentType string    `json:"content_type" example:"application/pdf"`
+		Size        int64     `json:"size"`
+		ReceivedAt  time.Time `json:"received_at"`
+	}
+
+	// PendingMessage - сообщение, оставленное пользователем в нерабочее время
+	PendingMessage struct {
+		LineId uuid.UUID `json:"line_id"`
+		UserId uuid.UUID `json:"user_id"`
+		Topic  string    `json:"topic,omitempty" example:"sick_leave"`
+		Text   string    `json:"text" example:"Нужна справка 2-НДФЛ"`
+		LeftAt time.Time `json:"left_at"`
 	}
 )
 
@@ -13,5 +80,17 @@ const (
 	STATE_DUMMY     = 0
 	STATE_GREETINGS = 100
 	STATE_MAIN_MENU = 300
-	STATE_PARTING   = 500
+
+	STATE_WAIT_SICK_LEAVE = 310
+	STATE_DOCUMENTS       = 320
+
+	STATE_PARTING = 500
+
+	STATE_OFF_HOURS     = 600
+	STATE_LEAVE_MESSAGE = 610
+
+	STATE_FORM = 700
+
+	STATE_SURVEY         = 800
+	STATE_SURVEY_COMMENT = 810
 )
@@ -3,6 +3,7 @@ module connect-companion
 go 1.14
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/gin-gonic/gin v1.6.2
 	github.com/go-redis/redis/v7 v7.2.0
 	github.com/google/uuid v1.1.1
@@ -0,0 +1,101 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"connect-companion/bot"
+	"connect-companion/bot/client"
+	"connect-companion/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	PING_TIMEOUT = 2 * time.Second
+)
+
+type (
+	Check struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}
+
+	// Readiness - подробности проверки готовности принимать сообщения
+	Readiness struct {
+		Ready    bool             `json:"ready"`
+		Draining bool             `json:"draining"`
+		Redis    Check            `json:"redis"`
+		Connect  ConnectCheck     `json:"connect"`
+		Hooks    []bot.HookStatus `json:"hooks"`
+	}
+
+	ConnectCheck struct {
+		Ok bool `json:"ok"`
+		client.Status
+	}
+)
+
+var (
+	started = time.Now()
+)
+
+// Init регистрирует /healthz (процесс жив) и /readyz (бот может обслуживать линии)
+func Init(app *gin.Engine) {
+	app.GET("/healthz", healthz)
+	app.GET("/readyz", readyz)
+}
+
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"ok":     true,
+		"uptime": time.Since(started).Round(time.Second).String(),
+	})
+}
+
+// readyz отвечает 503, если Redis недоступен, последний вызов API Connect завершился
+// ошибкой, хук на какой-то из линий не установлен или бот останавливается
+func readyz(c *gin.Context) {
+	cnf := c.MustGet("cnf").(*config.Conf)
+	db := c.MustGet("db").(redis.UniversalClient)
+
+	readiness := Readiness{
+		Ready:    true,
+		Draining: bot.Draining(),
+		Redis:    ping(db),
+		Hooks:    bot.HooksStatus(cnf.Line),
+	}
+
+	status := client.GetStatus()
+	readiness.Connect = ConnectCheck{Ok: status.Healthy(), Status: status}
+
+	if readiness.Draining || !readiness.Redis.Ok || !readiness.Connect.Ok {
+		readiness.Ready = false
+	}
+	for _, hook := range readiness.Hooks {
+		if !hook.Registered {
+			readiness.Ready = false
+		}
+	}
+
+	code := http.StatusOK
+	if !readiness.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, readiness)
+}
+
+func ping(db redis.UniversalClient) Check {
+	ctx, cancel := context.WithTimeout(context.Background(), PING_TIMEOUT)
+	defer cancel()
+
+	err := db.ProcessContext(ctx, redis.NewStatusCmd("ping"))
+	if err != nil {
+		return Check{Error: err.Error()}
+	}
+
+	return Check{Ok: true}
+}